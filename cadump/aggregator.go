@@ -3,17 +3,20 @@ package cadump
 import (
 	"fmt"
 	"sort"
+	"strings"
+	"sync"
 )
 
+// OtherChannel is the counts column of the channels out of the configured list
+const OtherChannel = "Other"
+
 type HotelCounts struct {
 	HotelName string `csv:"Hotel name"`
 	HotelCode string `csv:"Hotel Code"`
 	CIDate    string `csv:"CI date"`
-	Marriott  uint   `csv:"Marriott"`
-	Booking   uint   `csv:"Booking"`
-	Expedia   uint   `csv:"Expedia"`
-	Ctrip     uint   `csv:"Ctrip"`
-	Priceline uint   `csv:"Priceline"`
+
+	// rooms count by channel
+	Counts map[string]uint `csv:"-"`
 }
 
 func hotelsCountsSortFn(counts []HotelCounts) func(int, int) bool {
@@ -28,15 +31,50 @@ func hotelsCountsSortFn(counts []HotelCounts) func(int, int) bool {
 	}
 }
 
+// Aggregator counts rooms of each hotel by channels. It is safe for concurrent use.
+//
+// With channels list all other channels are counted as OtherChannel, without the list
+// every seen channel gets its own column.
 type Aggregator struct {
-	hotels map[string]*HotelCounts
+	mu       sync.Mutex
+	channels []string
+	known    map[string]string // lower case channel to the configured column
+	seen     map[string]bool
+	hotels   map[string]*HotelCounts
 }
 
-func NewAggregator() *Aggregator {
-	return &Aggregator{hotels: make(map[string]*HotelCounts)}
+// NewAggregator is Aggregator constructor, channels set counts columns and their order.
+// Channels are matched case-insensitively as in the filter, rooms are counted in the configured column.
+func NewAggregator(channels ...string) *Aggregator {
+	known := make(map[string]string)
+	for _, channel := range channels {
+		known[strings.ToLower(channel)] = channel
+	}
+
+	return &Aggregator{
+		channels: channels,
+		known:    known,
+		seen:     make(map[string]bool),
+		hotels:   make(map[string]*HotelCounts)}
 }
 
 func (agg *Aggregator) AddRoom(room Room) {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+
+	agg.addRoom(room)
+}
+
+func (agg *Aggregator) AddRooms(rooms []Room) {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+
+	for _, room := range rooms {
+		agg.addRoom(room)
+	}
+}
+
+func (agg *Aggregator) addRoom(room Room) {
 	var hotel *HotelCounts
 
 	key := fmt.Sprintf("%s-%s", room.HotelCode, room.CIDate)
@@ -46,38 +84,95 @@ func (agg *Aggregator) AddRoom(room Room) {
 		hotel = &HotelCounts{
 			HotelName: room.HotelName,
 			HotelCode: room.HotelCode,
-			CIDate:    room.CIDate}
+			CIDate:    room.CIDate,
+			Counts:    make(map[string]uint)}
 		agg.hotels[key] = hotel
 	}
 
-	switch room.Channel {
-	case "Marriott":
-		hotel.Marriott++
-	case "Booking":
-		hotel.Booking++
-	case "Expedia":
-		hotel.Expedia++
-	case "Ctrip":
-		hotel.Ctrip++
-	case "Priceline":
-		hotel.Priceline++
-	default:
-		log.Warningf("Unknown chanel '%s' (hotel_code: %s, CI: %s)",
-			room.Channel, room.HotelCode, room.CIDate)
+	channel := room.Channel
+	if len(agg.channels) > 0 {
+		column, known := agg.known[strings.ToLower(channel)]
+		channel = column
+		if !known {
+			channel = OtherChannel
+		}
 	}
+	if channel == "" {
+		channel = OtherChannel
+	}
+	agg.seen[channel] = true
+	hotel.Counts[channel]++
 }
 
-func (agg *Aggregator) AddRooms(rooms []Room) {
-	for _, room := range rooms {
-		agg.AddRoom(room)
+// Channels return counts columns: configured channels (or all seen channels sorted by name) and OtherChannel
+func (agg *Aggregator) Channels() []string {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+
+	return agg.columns()
+}
+
+func (agg *Aggregator) columns() []string {
+	channels := append([]string{}, agg.channels...)
+	if len(channels) == 0 {
+		for channel := range agg.seen {
+			if channel != OtherChannel {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
 	}
+	return append(channels, OtherChannel)
 }
 
 func (agg *Aggregator) HotelsCounts() []HotelCounts {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+
 	counts := make([]HotelCounts, 0, len(agg.hotels))
 	for key := range agg.hotels {
-		counts = append(counts, *agg.hotels[key])
+		hotel := *agg.hotels[key]
+		hotel.Counts = make(map[string]uint, len(agg.hotels[key].Counts))
+		for channel, count := range agg.hotels[key].Counts {
+			hotel.Counts[channel] = count
+		}
+		counts = append(counts, hotel)
 	}
 	sort.Slice(counts, hotelsCountsSortFn(counts))
 	return counts
 }
+
+// HotelsCountsTable return hotels counts with the channel columns
+func (agg *Aggregator) HotelsCountsTable() *HotelsCountsTable {
+	agg.mu.Lock()
+	channels := agg.columns()
+	agg.mu.Unlock()
+
+	return &HotelsCountsTable{Channels: channels, Rows: agg.HotelsCounts()}
+}
+
+// ----- Hotels counts table -----
+
+// HotelsCountsTable is hotels counts with dynamic channel columns
+type HotelsCountsTable struct {
+	Channels []string
+	Rows     []HotelCounts
+}
+
+// Header return hotel columns ("csv" tags of HotelCounts) and channels
+func (table *HotelsCountsTable) Header() []string {
+	return append(getTags(HotelCounts{}, "csv"), table.Channels...)
+}
+
+// Records return table rows: hotel fields and counts of the channels
+func (table *HotelsCountsTable) Records() [][]interface{} {
+	records := make([][]interface{}, 0, len(table.Rows))
+	for _, row := range table.Rows {
+		record := []interface{}{row.HotelName, row.HotelCode, row.CIDate}
+		for _, channel := range table.Channels {
+			record = append(record, row.Counts[channel])
+		}
+		records = append(records, record)
+	}
+	return records
+}
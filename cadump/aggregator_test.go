@@ -1,6 +1,7 @@
 package cadump_test
 
 import (
+	"sync"
 	"testing"
 
 	"cadump/cadump"
@@ -10,12 +11,8 @@ import (
 
 var testRoom1 = cadump.Room{HotelName: "Beverly Hills", HotelCode: "BH-19210", CIDate: "31/12/2018"}
 var testRoom2 = cadump.Room{HotelName: "Hotel California", HotelCode: "HC1980", CIDate: "10/11/2018"}
-var testHCount1 = cadump.HotelCounts{
-	HotelName: "Beverly Hills", HotelCode: "BH-19210", CIDate: "31/12/2018",
-	Marriott: 0, Booking: 0, Expedia: 0, Ctrip: 0, Priceline: 0}
-var testHCount2 = cadump.HotelCounts{
-	HotelName: "Hotel California", HotelCode: "HC1980", CIDate: "10/11/2018",
-	Marriott: 0, Booking: 0, Expedia: 0, Ctrip: 0, Priceline: 0}
+var testHCount1 = cadump.HotelCounts{HotelName: "Beverly Hills", HotelCode: "BH-19210", CIDate: "31/12/2018"}
+var testHCount2 = cadump.HotelCounts{HotelName: "Hotel California", HotelCode: "HC1980", CIDate: "10/11/2018"}
 
 func newRoom(room cadump.Room, channel string) cadump.Room {
 	room.Channel = channel
@@ -30,95 +27,88 @@ func Room2(channel string) cadump.Room {
 	return newRoom(testRoom2, channel)
 }
 
+func withCounts(hCount cadump.HotelCounts, counts map[string]uint) cadump.HotelCounts {
+	hCount.Counts = counts
+	return hCount
+}
+
 // ----- Tests -----
 
 func TestNewAggregator(t *testing.T) {
 	agg := cadump.NewAggregator()
 	counts := agg.HotelsCounts()
 	equals(t, make([]cadump.HotelCounts, 0), counts)
+	equals(t, []string{"Other"}, agg.Channels())
 }
 
 func TestAggregator_AddRoom_NewOrExist(t *testing.T) {
-	hCount1, hCount2 := testHCount1, testHCount2
-
 	agg := cadump.NewAggregator()
 	equals(t, []cadump.HotelCounts{}, agg.HotelsCounts())
 
 	agg.AddRoom(Room1("Booking"))
-	hCount1.Booking++
-	equals(t, []cadump.HotelCounts{hCount1}, agg.HotelsCounts())
+	equals(t, []cadump.HotelCounts{
+		withCounts(testHCount1, map[string]uint{"Booking": 1})}, agg.HotelsCounts())
 
 	agg.AddRoom(Room1("Booking"))
-	hCount1.Booking++
-	equals(t, []cadump.HotelCounts{hCount1}, agg.HotelsCounts())
+	equals(t, []cadump.HotelCounts{
+		withCounts(testHCount1, map[string]uint{"Booking": 2})}, agg.HotelsCounts())
 
 	agg.AddRoom(Room2("Booking"))
-	hCount2.Booking++
-	equals(t, []cadump.HotelCounts{hCount1, hCount2}, agg.HotelsCounts())
+	equals(t, []cadump.HotelCounts{
+		withCounts(testHCount1, map[string]uint{"Booking": 2}),
+		withCounts(testHCount2, map[string]uint{"Booking": 1})}, agg.HotelsCounts())
 }
 
-func TestAggregator_AddRoom_AllChannels(t *testing.T) {
-	hCounts1, hCounts2 := testHCount1, testHCount2
+func TestAggregator_AddRoom_SeenChannels(t *testing.T) {
 	agg := cadump.NewAggregator()
 
-	for _, chName := range []string{"Marriott", "Booking", "Expedia", "Ctrip", "Priceline"} {
+	for _, chName := range []string{"Marriott", "Booking", "Expedia", "Ctrip", "Priceline", "Trivago", ""} {
 		agg.AddRoom(Room1(chName))
 	}
-
-	hCounts1.Marriott++
-	hCounts1.Booking++
-	hCounts1.Expedia++
-	hCounts1.Ctrip++
-	hCounts1.Priceline++
-
-	equals(t, []cadump.HotelCounts{hCounts1}, agg.HotelsCounts())
-
-	for _, chName := range []string{"Marriott", "Booking", "Expedia"} {
-		agg.AddRoom(Room2(chName))
-	}
-
-	hCounts2.Marriott++
-	hCounts2.Booking++
-	hCounts2.Expedia++
-
-	equals(t, []cadump.HotelCounts{hCounts1, hCounts2}, agg.HotelsCounts())
-
 	for i := 0; i < 10; i++ {
 		agg.AddRoom(Room2("Priceline"))
-		hCounts2.Priceline++
 	}
 
-	equals(t, []cadump.HotelCounts{hCounts1, hCounts2}, agg.HotelsCounts())
-
-	agg.AddRoom(Room1("unknown"))
-
-	equals(t, []cadump.HotelCounts{hCounts1, hCounts2}, agg.HotelsCounts())
+	equals(t, []string{"Booking", "Ctrip", "Expedia", "Marriott", "Priceline", "Trivago", "Other"}, agg.Channels())
+	equals(t, []cadump.HotelCounts{
+		withCounts(testHCount1, map[string]uint{
+			"Marriott": 1, "Booking": 1, "Expedia": 1, "Ctrip": 1, "Priceline": 1, "Trivago": 1, "Other": 1}),
+		withCounts(testHCount2, map[string]uint{"Priceline": 10})}, agg.HotelsCounts())
 }
 
-func TestAggregator_AddRooms(t *testing.T) {
+func TestAggregator_AddRooms_ConfiguredChannels(t *testing.T) {
 	var rooms []cadump.Room
-	hCounts1, hCounts2 := testHCount1, testHCount2
-	agg := cadump.NewAggregator()
+	agg := cadump.NewAggregator("Marriott", "Booking", "Expedia")
 
 	for _, chName := range []string{"Marriott", "Booking", "Expedia", "Ctrip", "Priceline", "Unknown"} {
 		rooms = append(rooms, Room1(chName), Room2(chName))
 	}
+	agg.AddRooms(rooms)
+
+	counts := map[string]uint{"Marriott": 1, "Booking": 1, "Expedia": 1, "Other": 3}
+	equals(t, []string{"Marriott", "Booking", "Expedia", "Other"}, agg.Channels())
+	equals(t, []cadump.HotelCounts{withCounts(testHCount1, counts), withCounts(testHCount2, counts)},
+		agg.HotelsCounts())
+}
 
-	hCounts1.Marriott++
-	hCounts1.Booking++
-	hCounts1.Expedia++
-	hCounts1.Ctrip++
-	hCounts1.Priceline++
+func TestAggregator_AddRooms_ConfiguredChannelsCase(t *testing.T) {
+	agg := cadump.NewAggregator("booking", "EXPEDIA")
+	agg.AddRooms([]cadump.Room{Room1("Booking"), Room1("booking"), Room1("Expedia"), Room1("Ctrip")})
 
-	hCounts2.Marriott++
-	hCounts2.Booking++
-	hCounts2.Expedia++
-	hCounts2.Ctrip++
-	hCounts2.Priceline++
+	equals(t, []string{"booking", "EXPEDIA", "Other"}, agg.Channels())
+	equals(t, []cadump.HotelCounts{
+		withCounts(testHCount1, map[string]uint{"booking": 2, "EXPEDIA": 1, "Other": 1})}, agg.HotelsCounts())
+}
 
-	agg.AddRooms(rooms)
+func TestAggregator_HotelsCountsTable(t *testing.T) {
+	agg := cadump.NewAggregator("Marriott", "Booking")
+	agg.AddRooms([]cadump.Room{Room1("Booking"), Room1("Trivago"), Room2("Marriott")})
 
-	equals(t, []cadump.HotelCounts{hCounts1, hCounts2}, agg.HotelsCounts())
+	table := agg.HotelsCountsTable()
+	equals(t, []string{"Hotel name", "Hotel Code", "CI date", "Marriott", "Booking", "Other"}, table.Header())
+	equals(t, [][]interface{}{
+		{"Beverly Hills", "BH-19210", "31/12/2018", uint(0), uint(1), uint(1)},
+		{"Hotel California", "HC1980", "10/11/2018", uint(1), uint(0), uint(0)}}, table.Records())
 }
 
 func TestAggregator_HotelsCounts_Sort(t *testing.T) {
@@ -133,10 +123,30 @@ func TestAggregator_HotelsCounts_Sort(t *testing.T) {
 	agg.AddRooms(rooms)
 	counts := agg.HotelsCounts()
 
+	marriott := map[string]uint{"Marriott": 1}
 	equals(t, []cadump.HotelCounts{
-		{HotelName: "AbuDabi hotel", HotelCode: "ZA-42", CIDate: "31/02/2018", Marriott: 1},
-		{HotelName: "AbuDabi hotel", HotelCode: "ZA-42", CIDate: "01/05/2018", Marriott: 1},
-		{HotelName: "Bee house", HotelCode: "BZB-ksv", CIDate: "31/02/2018", Marriott: 1},
-		{HotelName: "Dubrova house", HotelCode: "AGG", CIDate: "20/01/2018", Marriott: 1},
+		{HotelName: "AbuDabi hotel", HotelCode: "ZA-42", CIDate: "31/02/2018", Counts: marriott},
+		{HotelName: "AbuDabi hotel", HotelCode: "ZA-42", CIDate: "01/05/2018", Counts: marriott},
+		{HotelName: "Bee house", HotelCode: "BZB-ksv", CIDate: "31/02/2018", Counts: marriott},
+		{HotelName: "Dubrova house", HotelCode: "AGG", CIDate: "20/01/2018", Counts: marriott},
 	}, counts)
 }
+
+func TestAggregator_AddRooms_Concurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	agg := cadump.NewAggregator()
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agg.AddRooms([]cadump.Room{Room1("Booking"), Room2("Expedia")})
+			agg.AddRoom(Room1("Ctrip"))
+		}()
+	}
+	wg.Wait()
+
+	equals(t, []cadump.HotelCounts{
+		withCounts(testHCount1, map[string]uint{"Booking": 20, "Ctrip": 20}),
+		withCounts(testHCount2, map[string]uint{"Expedia": 20})}, agg.HotelsCounts())
+}
@@ -4,186 +4,97 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
-	"time"
-
-	"github.com/integrii/flaggy"
-	"github.com/op/go-logging"
 )
 
-const version = "1.0.0"
-const description = `is Cassandra scan results processing script. 
-It extracts the results of the scan from Cassandra 'scan_data' table with specified scan_id.
-Script splits those results by rooms and also counts the number of rooms for each hotel and provider.
-All results saved in temp files and uploaded on FTP.
-`
-
-const logLevel = "INFO"
-const logFormat = `%{color}%{time:2006-01-02 15:04:05.000} %{level:.4s} ▶ %{color:reset}%{message}`
-
-var scanTimestamp = time.Now().Format("2006_01_02-15_04_05")
+// Version is cadump version
+const Version = "1.0.0"
 
-// ----- Logger -----
-
-var log = logging.MustGetLogger("cadump")
-
-func initLogger(level string) {
-	logLev, err := logging.LogLevel(level)
-	if err != nil {
-		logLev = logging.INFO
-	}
+// ----- Scan rooms file -----
 
-	backend := logging.AddModuleLevel(
-		logging.NewBackendFormatter(
-			logging.NewLogBackend(os.Stderr, "", 0),
-			logging.MustStringFormatter(logFormat)))
-	backend.SetLevel(logLev, "")
+// scanRoomsFile is rooms file of the single scan.
+// File is created on the first write, because its name contains the rooms channel.
+type scanRoomsFile struct {
+	scanID    uint
+	folder    string
+	timestamp string
+	newWriter WriterFactory
+	extra     []string // extra columns names
 
-	log.SetBackend(backend)
+	channel string
+	writer  Writer
 }
 
-// ----- Parse args -----
-
-func parseArgs() (configFile string, scanIDs []uint, err error) {
-	flaggy.SetName("cadump")
-	flaggy.SetDescription(description)
-	flaggy.SetVersion(version)
+// Write append rooms to the file
+func (file *scanRoomsFile) Write(rooms []Room) error {
+	if len(rooms) == 0 {
+		return nil
+	}
 
-	flaggy.String(&configFile, "c", "config", "Project YAML configuration file")
-	flaggy.UIntSlice(&scanIDs, "s", "sid", "Scan ID to process (can to set multiple values)")
+	if file.writer == nil {
+		file.channel = rooms[0].Channel
+		LogWith(Fields{"scan_id": file.scanID, "channel": file.channel}).Infof("Saving rooms to file")
 
-	flaggy.Parse()
+		basePath := filepath.Join(
+			file.folder, fmt.Sprintf("rooms-%s-%s-%d", file.timestamp, file.channel, file.scanID))
+		writer, err := file.newWriter(OutputRooms, basePath)
+		if err != nil {
+			return fmt.Errorf("save rooms error: %s", err)
+		}
+		file.writer = writer
+	}
 
-	if configFile == "" {
-		err = fmt.Errorf("configuration YAML file not set")
+	var rows interface{} = rooms
+	if len(file.extra) > 0 {
+		rows = &RoomsTable{Extra: file.extra, Rows: rooms}
 	}
-	if len(scanIDs) == 0 {
-		err = fmt.Errorf("scan id not set")
+	if err := file.writer.Write(rows); err != nil {
+		return fmt.Errorf("save rooms error: %s", err)
 	}
-
-	return
+	return nil
 }
 
-// ----- Process data -----
-
-// ProcessScan is a main function of the project
-func ProcessScan() {
-	var roomFiles []string
-	initLogger(logLevel)
-
-	cnfFile, scanIDs, err := parseArgs()
-	checkFatalError("Arguments parse error", err)
-
-	config, err := LoadConfig(cnfFile)
-	checkFatalError("Load config error", err)
-
-	csvSaver := SaveToCSV
-	if config.CompressCSV {
-		csvSaver = SaveToCSVZipped
-	}
-
-	aggregator := NewAggregator()
-	db := NewCassandraReader(config.Cassandra.Hosts, config.Cassandra.Keyspace)
-
-	log.Infof("Start Scan Data processing for Scan IDs [%s]\n", scanIDsStr(scanIDs, ", "))
-	for _, scanID := range scanIDs {
-		rooms, err := processScanData(scanID, db, aggregator)
-		checkFatalError(fmt.Sprintf("Process Scan Data [%d] error", scanID), err)
-		if len(rooms) == 0 {
-			continue
-		}
-
-		sort.Slice(rooms, roomsSortFn(rooms))
-
-		channel := rooms[0].Channel
-		log.Infof("Saving rooms to CSV file (scan id: %d, channel: %s)", scanID, channel)
-		roomFileName := filepath.Join(
-			config.TMPFolder, fmt.Sprintf("rooms-%s-%s-%d.csv", scanTimestamp, channel, scanID))
-		roomFileName, err = csvSaver(roomFileName, rooms)
-		checkFatalError("Save rooms error", err)
-		roomFiles = append(roomFiles, roomFileName)
-		log.Infof("Rooms with channel %s(%d) saved to '%s'", channel, scanID, roomFileName)
+// resume continue the file of the channel written by the failed run, writer is opened from the checkpoint offset
+func (file *scanRoomsFile) resume(channel string, writer Writer) {
+	file.channel, file.writer = channel, writer
+}
 
-		if config.RemoveTMPFiles {
-			defer removeFile(roomFileName)
-		}
+// offset flush written rooms and return the file name and its size, name is empty if nothing was written
+func (file *scanRoomsFile) offset() (string, int64, error) {
+	if file.writer == nil {
+		return "", 0, nil
 	}
 
-	log.Infof("Saving hotels counters to CSV file")
-
-	hotelsCountsFileName := filepath.Join(
-		config.TMPFolder, fmt.Sprintf("hotels_counts-%s-%s.csv", scanTimestamp, scanIDsStr(scanIDs, "_")))
-	hotelsCountsFileName, err = csvSaver(hotelsCountsFileName, aggregator.HotelsCounts())
-	checkFatalError("Save hotels counters error", err)
-	log.Infof("Hotels counts saved to '%s'", hotelsCountsFileName)
-
-	if config.RemoveTMPFiles {
-		defer removeFile(hotelsCountsFileName)
+	writer, ok := file.writer.(offsetWriter)
+	if !ok {
+		return "", 0, fmt.Errorf("rooms file '%s' can't be continued", file.writer.FileName())
 	}
-
-	if config.FTP.Host != "" {
-		for _, roomFileName := range roomFiles {
-			err = UploadFileToFTP(roomFileName, config.FTP.Host, config.FTP.User, config.FTP.Password)
-			checkFatalError("Upload file error", err)
-		}
-
-		err = UploadFileToFTP(hotelsCountsFileName, config.FTP.Host, config.FTP.User, config.FTP.Password)
-		checkFatalError("Upload file error", err)
+	offset, err := writer.Offset()
+	if err != nil {
+		return "", 0, fmt.Errorf("save rooms error: %s", err)
 	}
+	return writer.FileName(), offset, nil
 }
 
-func processScanData(scanID uint, db *CassandraReader, aggregator *Aggregator) ([]Room, error) {
-	var count uint = 0
-	var tableRow ScanDataTable
-	var allRooms []Room
-
-	iter, err := db.SelectScanData(scanID, &tableRow)
-	if err != nil {
-		return allRooms, fmt.Errorf("select scan_data error: %s", err)
+// Close close the file and return its name (empty if nothing was written)
+func (file *scanRoomsFile) Close() (string, error) {
+	if file.writer == nil {
+		return "", nil
 	}
 
-	defer func(i SelectIter) {
-		err := i.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}(iter)
-
-	for iter.Next() {
-		rooms, err := ExtractRooms(tableRow)
-		if err != nil {
-			return allRooms, fmt.Errorf("parse rooms error: %s", err)
-		}
-		if len(rooms) == 0 {
-			continue
-		}
-		if len(rooms) == 1 && rooms[0].Rate == "" {
-			// skip unavailable hotels
-			continue
-		}
-		allRooms = append(allRooms, rooms...)
-		aggregator.AddRooms(rooms)
-
-		count++
-		if count%100 == 0 {
-			log.Infof("[%d] => processed %d rows", scanID, count)
-		}
+	fileName := file.writer.FileName()
+	err := file.writer.Close()
+	file.writer = nil
+	if err != nil {
+		return fileName, fmt.Errorf("save rooms error: %s", err)
 	}
-	log.Infof("[ScanID: %d] Processed %d rows. Extracted %d rooms",
-		scanID, count, len(allRooms))
 
-	return allRooms, nil
+	LogWith(Fields{"scan_id": file.scanID, "channel": file.channel, "file": fileName}).Infof("Rooms saved")
+	return fileName, nil
 }
 
 // ----- Helpers -----
 
-func checkFatalError(prefix string, err error) {
-	if err != nil {
-		log.Fatalf("%s: %s", prefix, err)
-	}
-}
-
 func scanIDsStr(sids []uint, sep string) string {
 	var sidsStr []string
 	for _, sid := range sids {
@@ -193,9 +104,11 @@ func scanIDsStr(sids []uint, sep string) string {
 }
 
 func removeFile(file string) {
-	log.Infof("Removing file '%s'", file)
-	err := os.Remove(file)
-	checkFatalError(fmt.Sprintf("Remove file '%s' error", file), err)
+	fileLog := LogWith(Fields{"file": file})
+	fileLog.Infof("Removing file")
+	if err := os.Remove(file); err != nil {
+		fileLog.Warningf("Remove file error: %s", err)
+	}
 }
 
 // cmpDate revert date for sort (31/12/2018 -> 20181231)
@@ -1,8 +1,10 @@
 package cadump
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -11,9 +13,15 @@ import (
 )
 
 const (
-	pageSize          = 100
-	defaultTimeoutSec = 300
-	connAttempts      = 5
+	defaultScanDataTable   = "scan_data"
+	defaultScanIDColumn    = "aux_data_scan_id"
+	defaultPageSize        = 100
+	defaultTimeout         = 300 * time.Second
+	defaultConsistency     = gocql.One
+	defaultConnRetries     = 5
+	defaultConnRetryDelay  = 2 * time.Second
+	defaultQueryRetries    = 3
+	defaultQueryRetryDelay = 1 * time.Second
 )
 
 // ----- ScanData table -----
@@ -33,59 +41,164 @@ type ScanDataTable struct {
 
 // ----- Cassandra Reader -----
 
-// CassandraReader is Cassandra database connection config
+// CassandraReader is Cassandra database connection config.
+// Reader opens single session on the first query and shares it between all queries,
+// so it is safe to run queries from several goroutines.
 //
 // Example:
 //
-//	db := NewCassandraReader("cassandra-1", "keyspace")
+//	db := NewCassandraReader(CassandraConfig{Hosts: []string{"cassandra-1"}, Keyspace: "keyspace"})
+//	defer db.Close()
 //
 //	var table ScanDataTable
-//	iter, err := db.SelectScanData(90210, &table)
-//	checkFatalError(err)
-//
-//	defer func(i SelectIter) {
-//		checkFatalError(i.Close())
-//	}(iter)
+//	iter, err := db.SelectScanData(ctx, 90210, &table)
+//	if err != nil {
+//		return err
+//	}
 //
 //	for iter.Next() {
 //		fmt.Println(table.AuxDataName)
 //	}
-//
+//	return iter.Close()
 type CassandraReader struct {
 	conn *gocql.ClusterConfig
+
+	connRetries     int
+	connRetryDelay  time.Duration
+	queryRetries    int
+	queryRetryDelay time.Duration
+
+	schema      SchemaConfig
+	rangeSplits int
+	splitColumn string
+	pushFilters bool
+
+	mu      sync.Mutex
+	session *gocql.Session
 }
 
 // NewCassandraReader is CassandraReader constructor
-func NewCassandraReader(hosts []string, keyspace string) *CassandraReader {
-	conn := gocql.NewCluster(hosts...)
-	conn.Keyspace = keyspace
-	conn.Consistency = gocql.One
-	conn.PageSize = pageSize
-	conn.Timeout = time.Duration(defaultTimeoutSec) * time.Second
+func NewCassandraReader(config CassandraConfig) *CassandraReader {
+	conn := gocql.NewCluster(config.Hosts...)
+	conn.Keyspace = config.Keyspace
+	conn.Consistency = defaultConsistency
+	conn.PageSize = defaultPageSize
+	conn.Timeout = defaultTimeout
+
+	// consistency is checked by LoadConfig
+	if consistency, err := gocql.ParseConsistencyWrapper(config.Consistency); err == nil {
+		conn.Consistency = consistency
+	}
+	if config.PageSize > 0 {
+		conn.PageSize = config.PageSize
+	}
+	if config.Timeout > 0 {
+		conn.Timeout = config.Timeout
+	}
+	if config.ConnectTimeout > 0 {
+		conn.ConnectTimeout = config.ConnectTimeout
+	}
+	if config.Port > 0 {
+		conn.Port = config.Port
+	}
+	if config.ProtocolVersion > 0 {
+		conn.ProtoVersion = config.ProtocolVersion
+	}
+	if config.Username != "" {
+		conn.Authenticator = gocql.PasswordAuthenticator{Username: config.Username, Password: config.Password}
+	}
+	if config.TLS || config.TLSCAFile != "" || config.TLSCertFile != "" {
+		conn.SslOpts = &gocql.SslOptions{
+			CertPath:               config.TLSCertFile,
+			KeyPath:                config.TLSKeyFile,
+			CaPath:                 config.TLSCAFile,
+			EnableHostVerification: !config.TLSSkipVerify}
+	}
+	if config.LocalDC != "" {
+		conn.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(config.LocalDC))
+	}
 
-	return &CassandraReader{conn: conn}
+	reader := &CassandraReader{
+		conn:            conn,
+		connRetries:     config.ConnectRetries,
+		connRetryDelay:  config.ConnectRetryDelay,
+		queryRetries:    config.QueryRetries,
+		queryRetryDelay: config.QueryRetryDelay,
+		schema:          config.Schema,
+		rangeSplits:     config.RangeSplits,
+		splitColumn:     config.SplitColumn,
+		pushFilters:     config.PushFilters}
+
+	if reader.connRetries <= 0 {
+		reader.connRetries = defaultConnRetries
+	}
+	if reader.connRetryDelay <= 0 {
+		reader.connRetryDelay = defaultConnRetryDelay
+	}
+	if reader.queryRetries <= 0 {
+		reader.queryRetries = defaultQueryRetries
+	}
+	if reader.queryRetryDelay <= 0 {
+		reader.queryRetryDelay = defaultQueryRetryDelay
+	}
+	return reader
 }
 
-// createSession make connection to the Cassandra DB with retries
-func (reader *CassandraReader) createSession() (*gocql.Session, error) {
+// getSession return shared session, create it on the first call
+func (reader *CassandraReader) getSession(ctx context.Context) (*gocql.Session, error) {
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+
+	if reader.session == nil {
+		session, err := reader.createSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reader.session = session
+	}
+	return reader.session, nil
+}
+
+// Close close shared session if it was opened
+func (reader *CassandraReader) Close() {
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+
+	if reader.session != nil {
+		reader.session.Close()
+		reader.session = nil
+		log.Info("Cassandra connection closed")
+	}
+}
+
+// createSession make connection to the Cassandra DB with retries (retries stop if ctx is done)
+func (reader *CassandraReader) createSession(ctx context.Context) (*gocql.Session, error) {
 	var err error
-	connErrTimeout := 1 * time.Second
+	retryDelay := reader.connRetryDelay
+	start := time.Now()
 
-	log.Infof("Connecting to Cassandra %v (keyspace: %s)...",
-		reader.conn.Hosts, reader.conn.Keyspace)
+	log.Infof("Connecting to Cassandra %v (keyspace: %s, tls: %t)...",
+		reader.conn.Hosts, reader.conn.Keyspace, reader.conn.SslOpts != nil)
 
-	for attempt := 0; attempt <= connAttempts; attempt++ {
-		session, err := reader.conn.CreateSession()
+	for attempt := 0; attempt <= reader.connRetries; attempt++ {
+		var session *gocql.Session
+		session, err = reader.conn.CreateSession()
 		if err == nil {
 			log.Info("Got Cassandra connection")
+			metrics.observeStage(metricsStageConnect, time.Since(start))
 			return session, nil
 		}
-		log.Warningf("Error connect to Cassandra: %s (attempt %d of %d)",
-			err, attempt, connAttempts)
+		LogWith(Fields{"stage": StageConnect}).Warningf("Error connect to Cassandra: %s (attempt %d of %d)",
+			err, attempt, reader.connRetries)
 
-		if attempt < connAttempts {
-			connErrTimeout *= 2
-			time.Sleep(connErrTimeout)
+		if attempt < reader.connRetries {
+			metrics.retries.WithLabelValues("cassandra").Inc()
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			retryDelay *= 2
 		}
 	}
 
@@ -93,56 +206,558 @@ func (reader *CassandraReader) createSession() (*gocql.Session, error) {
 }
 
 // SelectScanData load rows from "scan_data" table without limit
-func (reader *CassandraReader) SelectScanData(scanID uint, dest *ScanDataTable) (SelectIter, error) {
-	return reader.SelectScanDataLimit(scanID, dest, 0)
+func (reader *CassandraReader) SelectScanData(ctx context.Context, scanID uint, dest *ScanDataTable) (ScanIter, error) {
+	iter, err := reader.SelectScanDataLimit(ctx, scanID, dest, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &iter, nil
 }
 
-// SelectScanDataLimit make query to select data from "scan_data" table with limit and map it to the dest struct
-func (reader *CassandraReader) SelectScanDataLimit(scanID uint, dest *ScanDataTable, limit uint) (SelectIter, error) {
-	session, err := reader.createSession()
+// SelectFilteredScanData load rows from "scan_data" table without limit, check-in dates filter is
+// added to the query if config.PushFilters is set. Other filters are not checked by the query.
+func (reader *CassandraReader) SelectFilteredScanData(
+	ctx context.Context, scanID uint, filter *RoomFilter, dest *ScanDataTable) (ScanIter, error) {
+
+	iter, err := reader.SelectScanDataLimit(ctx, scanID, dest, 0, filter)
 	if err != nil {
-		return SelectIter{}, err
+		return nil, err
 	}
+	return &iter, nil
+}
+
+// SelectScanDataFrom load rows from "scan_data" table without limit starting after the position
+// returned by the iterator of the previous query with the same filter
+func (reader *CassandraReader) SelectScanDataFrom(ctx context.Context, scanID uint, filter *RoomFilter,
+	pos ScanPosition, dest *ScanDataTable) (ResumableIter, error) {
 
-	columns := getTags(*dest, "cql")
-	query := qb.Select("scan_data").Where(qb.Eq("aux_data_scan_id")).Columns(columns...)
+	iter, err := reader.selectScanData(ctx, scanID, dest, 0, filter, pos)
+	if err != nil {
+		return nil, err
+	}
+	return &iter, nil
+}
+
+// Ping connect to Cassandra and return the server version
+func (reader *CassandraReader) Ping(ctx context.Context) (string, error) {
+	session, err := reader.getSession(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var version string
+	err = session.Query("SELECT release_version FROM system.local").WithContext(ctx).Scan(&version)
+	if err != nil {
+		return "", fmt.Errorf("select Cassandra version error: %s", err)
+	}
+	return version, nil
+}
+
+// SelectScanIDs run query selecting single scan ID column (int or bigint) with values of the bind markers,
+// non-positive IDs are skipped
+func (reader *CassandraReader) SelectScanIDs(ctx context.Context, query string, values ...interface{}) ([]uint, error) {
+	session, err := reader.getSession(ctx)
+	if err != nil {
+		return nil, stageError(StageConnect, err)
+	}
+
+	LogWith(Fields{"query": query, "params": values}).Debugf("Select scan IDs")
+
+	var scanIDs []uint
+	var scanID int64
+
+	iter := session.Query(query, values...).WithContext(ctx).Iter()
+	for iter.Scan(&scanID) {
+		if scanID > 0 {
+			scanIDs = append(scanIDs, uint(scanID))
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return nil, stageError(StageQuery, fmt.Errorf("select scan IDs error: %s", err))
+	}
+	return scanIDs, nil
+}
+
+// SelectScanDataLimit make query to select data from "scan_data" table with limit and map it to the dest struct.
+// Without limit the query is split into concurrent split column range sub-queries if reader has range splits.
+// Filter restrictions supported by the schema are added to the query (filter can be nil).
+// Query pages are not fetched anymore when ctx is done.
+func (reader *CassandraReader) SelectScanDataLimit(
+	ctx context.Context, scanID uint, dest *ScanDataTable, limit uint, filter *RoomFilter) (SelectIter, error) {
+
+	return reader.selectScanData(ctx, scanID, dest, limit, filter, ScanPosition{})
+}
+
+// selectScanData make scan_data query starting from the position
+func (reader *CassandraReader) selectScanData(ctx context.Context, scanID uint, dest *ScanDataTable,
+	limit uint, filter *RoomFilter, pos ScanPosition) (SelectIter, error) {
+
+	session, err := reader.getSession(ctx)
+	if err != nil {
+		return SelectIter{}, stageError(StageConnect, err)
+	}
+
+	columns := reader.selectColumns(getTags(*dest, "cql"))
+	queryParams := qb.M{"scan_id": scanID}
+	filterWhere := reader.pushedFilter(filter, queryParams)
+	scanIDWhere := qb.EqNamed(reader.schema.ScanIDColumnName(), "scan_id")
+
+	if limit == 0 && reader.rangeSplits > 1 {
+		iter, err := reader.selectKeyRanges(ctx, session, dest, columns, scanIDWhere, filterWhere, queryParams, pos)
+		if err != nil || iter.ranges != nil {
+			return iter, err
+		}
+	}
+
+	query := qb.Select(reader.schema.TableName()).Where(append([]qb.Cmp{scanIDWhere}, filterWhere...)...).
+		Columns(columns...)
+	if len(filterWhere) > 0 {
+		query = query.AllowFiltering()
+	}
 	if limit > 0 {
 		query = query.Limit(limit)
 	}
 	queryStr, names := query.ToCql()
-	queryParams := qb.M{"aux_data_scan_id": scanID}
-
-	log.Debugf("%s (aux_data_scan_id: %d)", queryStr, scanID)
 
-	iterx := gocqlx.Query(session.Query(queryStr), names).BindMap(queryParams).Iter().Unsafe()
+	queryLog := LogWith(Fields{"scan_id": scanID, "query": queryStr, "params": queryParams})
+	queryLog.Debugf("Select scan_data")
 
 	selectIter := SelectIter{
-		session: session,
-		dest:    dest,
-		iterx:   iterx}
+		dest:  dest,
+		paged: reader.newPagedIter(ctx, session, queryStr, names, queryParams, queryLog, pos)}
 
 	return selectIter, nil
 }
 
+// newPagedIter return iterator of the query pages retried with the reader query retries,
+// iteration starts from the page state and rows of the position
+func (reader *CassandraReader) newPagedIter(ctx context.Context, session *gocql.Session,
+	query string, names []string, params qb.M, queryLog FieldsLogger, pos ScanPosition) *pagedIter {
+
+	return &pagedIter{
+		ctx: ctx,
+		open: func(pageState []byte) pageIter {
+			// query with the page state fetches only that page, auto-paging is disabled by gocql
+			q := session.Query(query).WithContext(ctx).PageState(pageState)
+			return gocqlx.Query(q, names).BindMap(params).Iter().Unsafe()
+		},
+		retries:    reader.queryRetries,
+		retryDelay: reader.queryRetryDelay,
+		log:        queryLog,
+		pageState:  pos.PageState,
+		skip:       pos.PageRows}
+}
+
+// pushedFilter return query restrictions of the filter and add their values to the query params.
+// Only check-in dates range is pushed: channel is stored in other case and hotel code is in ext_data map.
+func (reader *CassandraReader) pushedFilter(filter *RoomFilter, params qb.M) []qb.Cmp {
+	if !reader.pushFilters {
+		return nil
+	}
+
+	var where []qb.Cmp
+	ciDate := reader.schema.Column("ci_date")
+	ciFrom, ciTo := filter.CIDateRange()
+	if !ciFrom.IsZero() {
+		where = append(where, qb.GtOrEqNamed(ciDate, "ci_from"))
+		params["ci_from"] = ciFrom
+	}
+	if !ciTo.IsZero() {
+		// ci_date can be timestamp, the whole last day is included
+		where = append(where, qb.LtNamed(ciDate, "ci_to"))
+		params["ci_to"] = ciTo.AddDate(0, 0, 1)
+	}
+	return where
+}
+
+// selectColumns return select expressions of the columns, mapped columns are renamed back to the default names
+func (reader *CassandraReader) selectColumns(columns []string) []string {
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		selected[i] = column
+		if mapped := reader.schema.Column(column); mapped != column {
+			selected[i] = fmt.Sprintf("%s AS %s", mapped, column)
+		}
+	}
+	return selected
+}
+
+// selectKeyRanges split the scan partition into ranges of the split column (the first clustering column,
+// date or timestamp) between its min and max values and run sub-query for every range concurrently.
+// Every sub-query reads only its slice of the partition, rows are returned range by range in the clustering
+// order, the same as single query returns them. Ranges before the position range are skipped,
+// so the resumed query must have the same bounds (the scan is finished and not changed).
+// Partition with less than 2 distinct split column values is read by single query.
+func (reader *CassandraReader) selectKeyRanges(ctx context.Context, session *gocql.Session, dest *ScanDataTable,
+	columns []string, scanIDWhere qb.Cmp, filterWhere []qb.Cmp, params qb.M, pos ScanPosition) (SelectIter, error) {
+
+	splitColumn := reader.schema.Column(reader.splitColumn)
+	descending, err := reader.checkSplitColumn(session, splitColumn)
+	if err != nil {
+		return SelectIter{}, stageError(StageConfig, err)
+	}
+
+	// check-in dates filter of the split column limits the bounds, the ranges are inside them.
+	// Filter of other column is added to the range queries, bounds are selected from the whole partition.
+	boundsWhere := []qb.Cmp{scanIDWhere}
+	if splitColumn == reader.schema.Column("ci_date") {
+		boundsWhere, filterWhere = append(boundsWhere, filterWhere...), nil
+	}
+	first, found, err := reader.selectBound(ctx, session, splitColumn, boundsWhere, params, qb.ASC)
+	if err != nil || !found {
+		return SelectIter{}, err
+	}
+	last, _, err := reader.selectBound(ctx, session, splitColumn, boundsWhere, params, qb.DESC)
+	if err != nil {
+		return SelectIter{}, err
+	}
+
+	ranges := splitKeyRange(first, last, reader.rangeSplits)
+	if len(ranges) < 2 {
+		return SelectIter{}, nil
+	}
+	if descending {
+		for i, j := 0, len(ranges)-1; i < j; i, j = i+1, j-1 {
+			ranges[i], ranges[j] = ranges[j], ranges[i]
+		}
+	}
+
+	rangeQuery := func(last bool) (string, []string) {
+		endWhere := qb.LtNamed(splitColumn, "range_end")
+		if last {
+			endWhere = qb.LtOrEqNamed(splitColumn, "range_end")
+		}
+		where := []qb.Cmp{scanIDWhere, qb.GtOrEqNamed(splitColumn, "range_start"), endWhere}
+		query := qb.Select(reader.schema.TableName()).Where(append(where, filterWhere...)...).Columns(columns...)
+		if len(filterWhere) > 0 {
+			// the same as of the single query, range of the first clustering column doesn't need it
+			query = query.AllowFiltering()
+		}
+		return query.ToCql()
+	}
+
+	open := func(index int, rangePos ScanPosition) rangeSource {
+		kr := ranges[index]
+		queryStr, names := rangeQuery(kr.last)
+		queryParams := qb.M{"range_start": kr.start, "range_end": kr.end}
+		for name, value := range params {
+			queryParams[name] = value
+		}
+		queryLog := LogWith(Fields{"scan_id": params["scan_id"], "query": queryStr, "params": queryParams})
+		queryLog.Debugf("Select scan_data key range")
+
+		return reader.newPagedIter(ctx, session, queryStr, names, queryParams, queryLog, rangePos)
+	}
+	return newRangesIter(dest, len(ranges), pos, reader.conn.PageSize, open), nil
+}
+
+// checkSplitColumn return error if the split column is not the first clustering column of the table:
+// range of other column can't be selected without reading the whole partition.
+// Returned flag is true if the column has descending clustering order.
+func (reader *CassandraReader) checkSplitColumn(session *gocql.Session, splitColumn string) (bool, error) {
+	keyspace, err := session.KeyspaceMetadata(reader.conn.Keyspace)
+	if err != nil {
+		return false, fmt.Errorf("read keyspace '%s' metadata error: %s", reader.conn.Keyspace, err)
+	}
+	table, ok := keyspace.Tables[reader.schema.TableName()]
+	if !ok {
+		return false, fmt.Errorf("table '%s' not found in keyspace '%s'", reader.schema.TableName(), reader.conn.Keyspace)
+	}
+	if len(table.ClusteringColumns) == 0 || table.ClusteringColumns[0].Name != splitColumn {
+		return false, fmt.Errorf("CASSANDRA split_column '%s' is not the first clustering column of '%s'",
+			splitColumn, reader.schema.TableName())
+	}
+	return table.ClusteringColumns[0].Order == gocql.DESC, nil
+}
+
+// selectBound return the first value of the split column in the order, it reads single row of the partition.
+// Returned flag is false if the partition has no rows.
+func (reader *CassandraReader) selectBound(ctx context.Context, session *gocql.Session, splitColumn string,
+	where []qb.Cmp, params qb.M, order qb.Order) (time.Time, bool, error) {
+
+	query, names := qb.Select(reader.schema.TableName()).Where(where...).Columns(splitColumn).
+		OrderBy(splitColumn, order).Limit(1).ToCql()
+	LogWith(Fields{"scan_id": params["scan_id"], "query": query, "params": params}).
+		Debugf("Select scan_data split bound")
+
+	var bound time.Time
+	err := gocqlx.Query(session.Query(query).WithContext(ctx), names).BindMap(params).Get(&bound)
+	if err == gocql.ErrNotFound {
+		return bound, false, nil
+	}
+	if err != nil {
+		return bound, false, stageError(StageQuery, fmt.Errorf("select scan_data split bound error: %s", err))
+	}
+	return bound, true, nil
+}
+
+// ----- Key ranges -----
+
+// keyRange is half-open range [start, end) of the split column values, the last range includes its end
+type keyRange struct {
+	start, end time.Time
+	last       bool
+}
+
+// minKeyRange is the shortest range of the split, the split has less ranges if the values span is short
+const minKeyRange = time.Millisecond
+
+// splitKeyRange split the values between min and max (inclusive) into n ranges of equal duration
+func splitKeyRange(min, max time.Time, n int) []keyRange {
+	span := max.Sub(min)
+	if maxRanges := span / minKeyRange; time.Duration(n) > maxRanges {
+		n = int(maxRanges)
+	}
+	if n < 1 {
+		return []keyRange{{start: min, end: max, last: true}}
+	}
+
+	step := span / time.Duration(n)
+	ranges := make([]keyRange, n)
+	for i := range ranges {
+		ranges[i] = keyRange{start: min.Add(step * time.Duration(i)), end: min.Add(step * time.Duration(i+1))}
+	}
+	ranges[n-1].end, ranges[n-1].last = max, true
+	return ranges
+}
+
+// rangeSource is the query of single range, pagedIter is used for Cassandra queries
+type rangeSource interface {
+	Next(dest interface{}) bool
+	Position() ScanPosition
+	Close() error
+}
+
+// newRangesIter return iterator reading n ranges concurrently starting from the position range,
+// open return the range query starting from the position (only the first one can be not empty).
+// Every range reader buffers up to bufSize rows.
+func newRangesIter(dest *ScanDataTable, n int, pos ScanPosition, bufSize int,
+	open func(index int, pos ScanPosition) rangeSource) SelectIter {
+
+	if pos.Range >= n {
+		pos = ScanPosition{Range: n}
+	}
+
+	done := make(chan struct{})
+	readers := make([]*rangeReader, n-pos.Range)
+	for i := range readers {
+		rangePos := ScanPosition{}
+		if i == 0 {
+			rangePos = ScanPosition{PageState: pos.PageState, PageRows: pos.PageRows}
+		}
+		readers[i] = &rangeReader{index: pos.Range + i, rows: make(chan rangeRow, bufSize)}
+		go readers[i].read(open(pos.Range+i, rangePos), done)
+	}
+
+	return SelectIter{dest: dest, ranges: readers, done: done, pos: ScanPosition{Range: pos.Range}}
+}
+
+// rangeReader read rows of single range sub-query into the buffered channel
+type rangeReader struct {
+	index int
+	rows  chan rangeRow
+	err   error
+}
+
+// rangeRow is the row of the range with the position after it
+type rangeRow struct {
+	row ScanDataTable
+	pos ScanPosition
+}
+
+func (rr *rangeReader) read(source rangeSource, done <-chan struct{}) {
+	defer close(rr.rows)
+
+	for {
+		var row ScanDataTable
+		if !source.Next(&row) {
+			break
+		}
+
+		pos := source.Position()
+		pos.Range = rr.index
+		select {
+		case rr.rows <- rangeRow{row: row, pos: pos}:
+		case <-done:
+			rr.err = source.Close()
+			return
+		}
+	}
+	rr.err = source.Close()
+}
+
+// ----- Paged query -----
+
+// pagedIter fetch query results page by page. Failed page fetch is retried with exponential backoff:
+// the query is run again from the page state of the current page and rows already read from it are skipped,
+// so the iteration continues from the failed row instead of the query start.
+// Iteration of the resumed query starts the same way: from the page state skipping rows read before.
+type pagedIter struct {
+	ctx        context.Context
+	open       func(pageState []byte) pageIter
+	retries    int
+	retryDelay time.Duration
+	log        FieldsLogger
+
+	iterx     pageIter
+	pageState []byte // state of the current page start, nil for the first page
+	pageRows  int    // rows of the current page already read (returned or skipped)
+	skip      int    // rows to skip after retry or resume
+	attempt   int
+	err       error
+}
+
+// pageIter is the iterator of the single page of the query, gocqlx.Iterx of the query with the page state
+type pageIter interface {
+	StructScan(dest interface{}) bool
+	PageState() []byte
+	Close() error
+}
+
+// Next scan the next row into dest, it returns false at the end of results or on error
+func (paged *pagedIter) Next(dest interface{}) bool {
+	if paged.err != nil {
+		return false
+	}
+	if paged.iterx == nil {
+		paged.iterx = paged.open(paged.pageState)
+	}
+
+	for {
+		if paged.iterx.StructScan(dest) {
+			paged.pageRows++
+			if paged.skip > 0 {
+				paged.skip--
+				continue
+			}
+			paged.attempt = 0
+			return true
+		}
+
+		nextState := paged.iterx.PageState()
+		err := paged.iterx.Close()
+		paged.iterx = nil
+
+		if err == nil {
+			if len(nextState) == 0 {
+				if paged.skip > 0 {
+					paged.err = fmt.Errorf("query has %d rows less than before retry", paged.skip)
+				}
+				return false
+			}
+			// rows to skip can be on the next page if page size is changed
+			paged.pageState, paged.pageRows = nextState, 0
+			paged.iterx = paged.open(paged.pageState)
+			continue
+		}
+
+		if !paged.wait(err) {
+			paged.err = err
+			return false
+		}
+		paged.skip += paged.pageRows
+		paged.pageRows = 0
+		paged.iterx = paged.open(paged.pageState)
+	}
+}
+
+// Position return position after the last returned row
+func (paged *pagedIter) Position() ScanPosition {
+	return ScanPosition{PageState: paged.pageState, PageRows: paged.pageRows}
+}
+
+// wait delay before the next attempt, it returns false if no attempts left or ctx is done
+func (paged *pagedIter) wait(err error) bool {
+	if paged.attempt >= paged.retries || paged.ctx.Err() != nil {
+		return false
+	}
+	paged.attempt++
+	paged.log.With(Fields{"stage": StageQuery}).Warningf("Error fetch query page: %s (retry %d of %d)",
+		err, paged.attempt, paged.retries)
+	metrics.retries.WithLabelValues("cassandra").Inc()
+
+	delay := paged.retryDelay << uint(paged.attempt-1)
+	select {
+	case <-time.After(delay):
+		return true
+	case <-paged.ctx.Done():
+		return false
+	}
+}
+
+// Close stop iteration and return the query error
+func (paged *pagedIter) Close() error {
+	if paged.iterx != nil {
+		if err := paged.iterx.Close(); err != nil && paged.err == nil {
+			paged.err = err
+		}
+		paged.iterx = nil
+	}
+	return paged.err
+}
+
 // ----- Select Query Iterator -----
 
 // SelectIter is DB Select query iterator
 type SelectIter struct {
-	session *gocql.Session
-	dest    *ScanDataTable
+	dest *ScanDataTable
+
+	paged *pagedIter
 
-	iterx *gocqlx.Iterx
+	// key range sub-queries
+	ranges []*rangeReader
+	done   chan struct{}
+	pos    ScanPosition
 }
 
 // Next is used to iterate over query results
 func (iter *SelectIter) Next() bool {
-	return iter.iterx.StructScan(iter.dest)
+	if iter.paged != nil {
+		return iter.paged.Next(iter.dest)
+	}
+
+	for len(iter.ranges) > 0 {
+		current := iter.ranges[0]
+		if row, ok := <-current.rows; ok {
+			*iter.dest, iter.pos = row.row, row.pos
+			return true
+		}
+		if current.err != nil {
+			// stop on the first failed range, Close returns the error
+			return false
+		}
+		iter.ranges = iter.ranges[1:]
+		iter.pos = ScanPosition{Range: current.index + 1}
+	}
+	return false
+}
+
+// Position return position after the last returned row, it is used to resume the query
+func (iter *SelectIter) Position() ScanPosition {
+	if iter.paged != nil {
+		return iter.paged.Position()
+	}
+	return iter.pos
 }
 
-// Close iteration and connect session and return error is exists
+// Close iteration and return error is exists (shared session stays open)
 func (iter *SelectIter) Close() error {
-	defer iter.session.Close()
-	return iter.iterx.Close()
+	if iter.paged != nil {
+		return iter.paged.Close()
+	}
+
+	close(iter.done)
+
+	var err error
+	for _, tr := range iter.ranges {
+		// wait until the range reader stops
+		for range tr.rows {
+		}
+		if tr.err != nil && err == nil {
+			err = tr.err
+		}
+	}
+	return err
 }
 
 // ----- Helper -----
@@ -155,7 +770,7 @@ func getTags(s interface{}, tag string) []string {
 	for fnum := 0; fnum < tblStructType.NumField(); fnum++ {
 		field := tblStructType.Field(fnum)
 		if fieldName, ok := field.Tag.Lookup(tag); ok {
-			if fieldName != "" {
+			if fieldName != "" && fieldName != "-" {
 				columns = append(columns, fieldName)
 			}
 		}
@@ -0,0 +1,179 @@
+package cadump_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cadump/cadump"
+)
+
+// ----- Helpers -----
+
+// testRanges return n ranges of rows with the hotel names "<range>-<row>"
+func testRanges(n, rows int) [][]cadump.ScanDataTable {
+	ranges := make([][]cadump.ScanDataTable, n)
+	for i := range ranges {
+		for j := 0; j < rows; j++ {
+			ranges[i] = append(ranges[i], cadump.ScanDataTable{AuxDataName: fmt.Sprintf("%d-%d", i, j)})
+		}
+	}
+	return ranges
+}
+
+// readRanges return hotel names of all rows of the iterator and the position after every row
+func readRanges(t *testing.T, iter cadump.SelectIter, dest *cadump.ScanDataTable) ([]string, []cadump.ScanPosition) {
+	var names []string
+	var positions []cadump.ScanPosition
+	for iter.Next() {
+		names = append(names, dest.AuxDataName)
+		positions = append(positions, iter.Position())
+	}
+	ok(t, iter.Close())
+	return names, positions
+}
+
+// ----- Tests -----
+
+func TestSplitKeyRange(t *testing.T) {
+	min := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	max := time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC)
+
+	ranges := cadump.SplitKeyRange(min, max, 3)
+	equals(t, []cadump.KeyRange{
+		{Start: min, End: time.Date(2020, 5, 11, 0, 0, 0, 0, time.UTC)},
+		{Start: time.Date(2020, 5, 11, 0, 0, 0, 0, time.UTC), End: time.Date(2020, 5, 21, 0, 0, 0, 0, time.UTC)},
+		{Start: time.Date(2020, 5, 21, 0, 0, 0, 0, time.UTC), End: max, Last: true},
+	}, ranges)
+
+	// the last range ends with max when the span is not divided evenly
+	ranges = cadump.SplitKeyRange(min, max, 7)
+	equals(t, 7, len(ranges))
+	equals(t, min, ranges[0].Start)
+	for i := 1; i < len(ranges); i++ {
+		equals(t, ranges[i-1].End, ranges[i].Start)
+		equals(t, false, ranges[i-1].Last)
+	}
+	equals(t, cadump.KeyRange{Start: ranges[6].Start, End: max, Last: true}, ranges[6])
+
+	// short span is split into less ranges
+	equals(t, 2, len(cadump.SplitKeyRange(min, min.Add(2*time.Millisecond), 8)))
+
+	// single value
+	equals(t, []cadump.KeyRange{{Start: min, End: min, Last: true}}, cadump.SplitKeyRange(min, min, 8))
+}
+
+func TestRangesIter_Order(t *testing.T) {
+	ranges := testRanges(4, 5)
+	ranges[2] = nil
+
+	var want []string
+	for _, rows := range ranges {
+		for _, row := range rows {
+			want = append(want, row.AuxDataName)
+		}
+	}
+
+	// rows are merged range by range, the first range is read last
+	var dest cadump.ScanDataTable
+	names, positions := readRanges(t, cadump.NewRangesIter(&dest, ranges, cadump.ScanPosition{}, 2), &dest)
+	equals(t, want, names)
+	equals(t, cadump.ScanPosition{Range: 0, PageRows: 1}, positions[0])
+	equals(t, cadump.ScanPosition{Range: 1, PageRows: 5}, positions[9])
+	equals(t, cadump.ScanPosition{Range: 3, PageRows: 1}, positions[10])
+}
+
+func TestRangesIter_Resume(t *testing.T) {
+	ranges := testRanges(3, 4)
+
+	var dest cadump.ScanDataTable
+	names, positions := readRanges(t, cadump.NewRangesIter(&dest, ranges, cadump.ScanPosition{}, 4), &dest)
+
+	// resumed iteration returns rows after the position
+	for i, pos := range positions {
+		resumed, _ := readRanges(t, cadump.NewRangesIter(&dest, ranges, pos, 4), &dest)
+		equals(t, len(names)-i-1, len(resumed))
+		if len(resumed) > 0 {
+			equals(t, names[i+1:], resumed)
+		}
+	}
+
+	// position after the last range
+	resumed, _ := readRanges(t, cadump.NewRangesIter(&dest, ranges, cadump.ScanPosition{Range: 3}, 4), &dest)
+	equals(t, 0, len(resumed))
+}
+
+func TestRangesIter_Close(t *testing.T) {
+	ranges := testRanges(3, 10)
+
+	// iteration is stopped before all ranges are read
+	var dest cadump.ScanDataTable
+	iter := cadump.NewRangesIter(&dest, ranges, cadump.ScanPosition{}, 1)
+	equals(t, true, iter.Next())
+	equals(t, "0-0", dest.AuxDataName)
+	ok(t, iter.Close())
+}
+
+func TestPagedIter_Retry(t *testing.T) {
+	ranges := testRanges(3, 3)
+
+	// fetch of the second page fails on its third row twice, rows read before the failure are skipped
+	pages := []*cadump.TestPage{{Rows: ranges[0]}, {Rows: ranges[1], FailAt: 2, Fails: 2}, {Rows: ranges[2]}}
+	var dest cadump.ScanDataTable
+	names, positions := readRanges(t, cadump.NewPagedIter(&dest, pages, 2, cadump.ScanPosition{}), &dest)
+	equals(t, []string{"0-0", "0-1", "0-2", "1-0", "1-1", "1-2", "2-0", "2-1", "2-2"}, names)
+	equals(t, []int{1, 3, 1}, []int{pages[0].Opens, pages[1].Opens, pages[2].Opens})
+	equals(t, cadump.ScanPosition{PageState: []byte{1}, PageRows: 2}, positions[4])
+
+	// resumed iteration skips rows of the position page
+	names, _ = readRanges(t, cadump.NewPagedIter(&dest, pages, 2, positions[4]), &dest)
+	equals(t, []string{"1-2", "2-0", "2-1", "2-2"}, names)
+}
+
+func TestPagedIter_RetriesExceeded(t *testing.T) {
+	ranges := testRanges(2, 3)
+
+	// the iteration stops on the failed row and Close returns the error
+	pages := []*cadump.TestPage{{Rows: ranges[0]}, {Rows: ranges[1], FailAt: 1, Fails: 3}}
+	var dest cadump.ScanDataTable
+	iter := cadump.NewPagedIter(&dest, pages, 2, cadump.ScanPosition{})
+	var names []string
+	for iter.Next() {
+		names = append(names, dest.AuxDataName)
+	}
+	equals(t, []string{"0-0", "0-1", "0-2", "1-0"}, names)
+	equals(t, "connection reset by peer", fmt.Sprint(iter.Close()))
+	equals(t, 3, pages[1].Opens)
+}
+
+func TestLoadConfig_SplitColumn(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-config")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	for _, test := range []struct {
+		cassandra string
+		err       string
+	}{
+		{"range_splits: 8\n    split_column: ci_date", ""},
+		{"range_splits: 8", "CASSANDRA split_column must be set with range_splits (the first clustering column)"},
+		{"range_splits: 8\n    split_column: aux_data_fuid",
+			"CASSANDRA split_column 'aux_data_fuid' is not date or timestamp"},
+		{"range_splits: 8\n    split_column: scan_time", "unknown CASSANDRA split_column 'scan_time'"},
+		{"range_splits: 1", ""},
+	} {
+		configFile := filepath.Join(tmpFolder, "config.yaml")
+		config := "CASSANDRA:\n    hosts: [cassandra-1]\n    keyspace: scans\n    " + test.cassandra + "\n"
+		ok(t, ioutil.WriteFile(configFile, []byte(config), 0644))
+
+		_, err := cadump.LoadConfig(configFile)
+		if test.err == "" {
+			ok(t, err)
+		} else {
+			equals(t, test.err, fmt.Sprint(err))
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package cadump
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- Scan position -----
+
+// ScanPosition is resumable position of the scan query: paging state of the current page and number
+// of rows already read from it. Range is the key range sub-query index if the scan is split into ranges.
+type ScanPosition struct {
+	Range     int    `json:"range,omitempty"`
+	PageState []byte `json:"page_state,omitempty"`
+	PageRows  int    `json:"page_rows,omitempty"`
+}
+
+// ----- Checkpoint -----
+
+// checkpoint is saved progress of the run with the scan IDs, failed run is resumed from it.
+// Timestamp and start of the first run are kept, so resumed run creates the same files.
+// ConfigHash is the hash of the config the written files depend on, see checkpointConfig.
+type checkpoint struct {
+	Timestamp  string           `json:"timestamp"`
+	Start      time.Time        `json:"start"`
+	ScanIDs    []uint           `json:"scan_ids"`
+	ConfigHash string           `json:"config_hash"`
+	Scans      []scanCheckpoint `json:"scans"`
+}
+
+// checkpointConfig is the part of the config which changes rooms or output files,
+// the run can be resumed only with the same values
+type checkpointConfig struct {
+	Filter       FilterConfig
+	Schema       SchemaConfig
+	ExtraColumns []ExtraColumnConfig
+	Lenient      bool
+	Output       OutputConfig
+	Outputs      []string
+	RangeSplits  int
+	SplitColumn  string
+}
+
+// checkpointConfigHash return SHA-256 of the checkpoint config of the run
+func checkpointConfigHash(cfg Config, outputs map[string]bool) (string, error) {
+	cpConfig := checkpointConfig{
+		Filter:       cfg.Filter,
+		Schema:       cfg.Cassandra.Schema,
+		ExtraColumns: cfg.ExtraColumns,
+		Lenient:      cfg.Lenient,
+		Output:       cfg.Output,
+		RangeSplits:  cfg.Cassandra.RangeSplits,
+		SplitColumn:  cfg.Cassandra.SplitColumn}
+	for output, enabled := range outputs {
+		if enabled {
+			cpConfig.Outputs = append(cpConfig.Outputs, output)
+		}
+	}
+	sort.Strings(cpConfig.Outputs)
+
+	// maps of the schema are marshalled with sorted keys, so the hash is stable
+	data, err := json.Marshal(cpConfig)
+	if err != nil {
+		return "", fmt.Errorf("checkpoint config hash error: %s", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// scanCheckpoint is progress of the single scan: query position after the last processed row,
+// number of processed rows and size of the rooms and rejects files written from these rows.
+// Resumed scan continues the files from the offsets, data written after the checkpoint is removed.
+type scanCheckpoint struct {
+	ScanID        uint         `json:"scan_id"`
+	Position      ScanPosition `json:"position"`
+	Rows          uint         `json:"rows"`
+	RoomsFile     string       `json:"rooms_file,omitempty"` // empty if no rooms were written
+	Channel       string       `json:"channel,omitempty"`
+	RoomsOffset   int64        `json:"rooms_offset"`
+	RejectsFile   string       `json:"rejects_file,omitempty"` // empty if no rows were rejected
+	Rejects       uint         `json:"rejects"`
+	RejectsOffset int64        `json:"rejects_offset"`
+	Done          bool         `json:"done"` // all rows of the scan are read
+}
+
+// checkpointer save progress of the run scans into the checkpoint file, it is safe for concurrent use
+type checkpointer struct {
+	mu    sync.Mutex
+	path  string
+	every uint // rows between checkpoints
+	cp    checkpoint
+}
+
+// newCheckpointer load checkpoint of the scan IDs if resume is set, otherwise (or if there is
+// no checkpoint) the new one is started and partial files of the previous checkpoint are removed.
+// Checkpoint saved with another config hash is not resumed and error is returned.
+// Returned flag is true if the run is resumed.
+func newCheckpointer(folder string, scanIDs []uint, every uint, resume bool, start time.Time,
+	configHash string) (*checkpointer, bool, error) {
+
+	cpr := &checkpointer{
+		path:  filepath.Join(folder, fmt.Sprintf("checkpoint-%s.json", scanIDsStr(scanIDs, "_"))),
+		every: every}
+
+	prev, err := loadCheckpoint(cpr.path)
+	if err != nil {
+		return nil, false, err
+	}
+	if resume && prev != nil {
+		if prev.ConfigHash != configHash {
+			return nil, false, fmt.Errorf("checkpoint '%s' was saved with different FILTER, CASSANDRA schema "+
+				"or range split, EXTRA_COLUMNS, LENIENT or OUTPUT config, run without resume to start over", cpr.path)
+		}
+		cpr.cp = *prev
+		return cpr, true, nil
+	}
+	if prev != nil {
+		for _, scan := range prev.Scans {
+			for _, file := range []string{scan.RoomsFile, scan.RejectsFile} {
+				if file != "" {
+					removeFile(file)
+				}
+			}
+		}
+	}
+
+	cpr.cp = checkpoint{Timestamp: start.Format(timestampFormat), Start: start, ScanIDs: scanIDs,
+		ConfigHash: configHash}
+	for _, scanID := range scanIDs {
+		cpr.cp.Scans = append(cpr.cp.Scans, scanCheckpoint{ScanID: scanID})
+	}
+	return cpr, false, cpr.write()
+}
+
+// loadCheckpoint read the checkpoint file, nil is returned if the file doesn't exist
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint error: %s", err)
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("parse checkpoint '%s' error: %s", path, err)
+	}
+	return &cp, nil
+}
+
+// scan return saved progress of the scan
+func (cpr *checkpointer) scan(scanID uint) scanCheckpoint {
+	cpr.mu.Lock()
+	defer cpr.mu.Unlock()
+
+	for _, scan := range cpr.cp.Scans {
+		if scan.ScanID == scanID {
+			return scan
+		}
+	}
+	return scanCheckpoint{ScanID: scanID}
+}
+
+// due return true if the checkpoint should be saved after the rows
+func (cpr *checkpointer) due(rows uint) bool {
+	return rows%cpr.every == 0
+}
+
+// save update progress of the scan and write the checkpoint file
+func (cpr *checkpointer) save(scan scanCheckpoint) error {
+	cpr.mu.Lock()
+	defer cpr.mu.Unlock()
+
+	for i := range cpr.cp.Scans {
+		if cpr.cp.Scans[i].ScanID == scan.ScanID {
+			cpr.cp.Scans[i] = scan
+		}
+	}
+	return cpr.write()
+}
+
+// write save the checkpoint into the temp file and rename it, so the checkpoint is never partial
+func (cpr *checkpointer) write() error {
+	data, err := json.MarshalIndent(cpr.cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("save checkpoint error: %s", err)
+	}
+	if err := ioutil.WriteFile(cpr.path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("save checkpoint error: %s", err)
+	}
+	if err := os.Rename(cpr.path+".tmp", cpr.path); err != nil {
+		return fmt.Errorf("save checkpoint error: %s", err)
+	}
+	return nil
+}
+
+// remove delete the checkpoint, files of the scans are the run files
+func (cpr *checkpointer) remove() {
+	cpr.mu.Lock()
+	defer cpr.mu.Unlock()
+
+	removeFile(cpr.path)
+}
+
+// ----- Resume -----
+
+// resumeBatchSize is the number of rooms read back from the rooms file at once
+const resumeBatchSize = 1000
+
+// readRooms read rooms from the first offset bytes of the CSV or JSONL rooms file and pass them
+// to add in batches. Only string fields are restored, they are enough for the hotels counts
+// and the scan summary.
+func readRooms(format string, fileName string, offset int64, add func([]Room)) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("open rooms file error: %s", err)
+	}
+	defer file.Close()
+
+	var next func() (map[string]string, error)
+	data := bufio.NewReader(io.LimitReader(file, offset))
+	if strings.ToLower(format) == FormatJSONL {
+		next = jsonlRecords(data)
+	} else {
+		next = csvRecords(data)
+	}
+
+	fields := make(map[string]int)
+	roomType := reflect.TypeOf(Room{})
+	for fnum := 0; fnum < roomType.NumField(); fnum++ {
+		field := roomType.Field(fnum)
+		if name := field.Tag.Get("csv"); name != "" && name != "-" && field.Type.Kind() == reflect.String {
+			fields[name] = fnum
+		}
+	}
+
+	var rooms []Room
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read rooms file '%s' error: %s", fileName, err)
+		}
+
+		var room Room
+		value := reflect.ValueOf(&room).Elem()
+		for name, fnum := range fields {
+			value.Field(fnum).SetString(record[name])
+		}
+		if rooms = append(rooms, room); len(rooms) == resumeBatchSize {
+			add(rooms)
+			rooms = nil
+		}
+	}
+	if len(rooms) > 0 {
+		add(rooms)
+	}
+	return nil
+}
+
+// csvRecords return function reading CSV records by the header columns
+func csvRecords(data io.Reader) func() (map[string]string, error) {
+	reader := csv.NewReader(data)
+	reader.FieldsPerRecord = -1
+	var header []string
+	return func() (map[string]string, error) {
+		values, err := reader.Read()
+		if err == nil && header == nil {
+			header = values
+			values, err = reader.Read()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		record := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(values) {
+				record[name] = values[i]
+			}
+		}
+		return record, nil
+	}
+}
+
+// jsonlRecords return function reading JSON objects line by line, string values are kept only
+func jsonlRecords(data io.Reader) func() (map[string]string, error) {
+	decoder := json.NewDecoder(data)
+	return func() (map[string]string, error) {
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			return nil, err
+		}
+
+		record := make(map[string]string, len(object))
+		for name, value := range object {
+			if str, ok := value.(string); ok {
+				record[name] = str
+			}
+		}
+		return record, nil
+	}
+}
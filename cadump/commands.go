@@ -0,0 +1,63 @@
+package cadump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ----- Inspect -----
+
+// InspectScan print first rows of the scan decoded into ScanDataTable as indented JSON objects
+func InspectScan(ctx context.Context, reader ScanReader, scanID uint, limit int, out io.Writer) (err error) {
+	var row ScanDataTable
+
+	iter, err := reader.SelectScanData(ctx, scanID, &row)
+	if err != nil {
+		return stageError(StageQuery, err)
+	}
+	defer func() {
+		if cerr := iter.Close(); cerr != nil && err == nil {
+			err = stageError(StageQuery, fmt.Errorf("[ScanID: %d] read scan_data error: %s", scanID, cerr))
+		}
+	}()
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	for rows := 0; rows < limit && iter.Next(); rows++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = encoder.Encode(row); err != nil {
+			return stageError(StageWrite, fmt.Errorf("print row error: %s", err))
+		}
+	}
+	return nil
+}
+
+// ----- Check -----
+
+// CheckConnections test connection to Cassandra and to all destinations which support checks
+func CheckConnections(ctx context.Context, cfg Config) error {
+	uploaders, err := NewUploaders(cfg)
+	if err != nil {
+		return stageError(StageConfig, err)
+	}
+	defer CloseUploaders(uploaders)
+
+	db := NewCassandraReader(cfg.Cassandra)
+	defer db.Close()
+
+	version, err := db.Ping(ctx)
+	if err != nil {
+		return stageError(StageConnect, err)
+	}
+	log.Infof("Cassandra %v is available (version %s)", cfg.Cassandra.Hosts, version)
+
+	if err = CheckUploaders(ctx, uploaders); err != nil {
+		return stageError(StageConnect, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package cadump_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"cadump/cadump"
+)
+
+// ----- Tests -----
+
+func TestInspectScan(t *testing.T) {
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow(), scanDataRow(), scanDataRow()}}}
+
+	var out bytes.Buffer
+	ok(t, cadump.InspectScan(context.Background(), reader, 42, 2, &out))
+
+	decoder := json.NewDecoder(&out)
+	var rows []map[string]interface{}
+	for decoder.More() {
+		var row map[string]interface{}
+		ok(t, decoder.Decode(&row))
+		rows = append(rows, row)
+	}
+	equals(t, 2, len(rows))
+	equals(t, "FPBS Kolasin", rows[0]["AuxDataName"])
+	equals(t, "00000000-1111-2222-3333-444444444444", rows[0]["AuxDataFuid"])
+}
+
+func TestCheckUploaders(t *testing.T) {
+	server := startFTPServer(t)
+	defer server.Close()
+
+	tmpFolder, err := ioutil.TempDir("", "cadump-check")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ftpUploader, err := cadump.NewUploader(server.dest())
+	ok(t, err)
+	defer ftpUploader.Close()
+
+	localUploader, err := cadump.NewUploader(cadump.DestinationConfig{Type: "local", Path: tmpFolder})
+	ok(t, err)
+
+	ok(t, cadump.CheckUploaders(context.Background(), []cadump.Uploader{localUploader, ftpUploader}))
+	equals(t, 1, len(server.commandsLike("USER")))
+
+	dest := server.dest()
+	dest.Password = "wrong"
+	wrongUploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+
+	err = cadump.CheckUploaders(context.Background(), []cadump.Uploader{wrongUploader})
+	equals(t, true, strings.Contains(err.Error(), "FTP '127.0.0.1' login error:"))
+}
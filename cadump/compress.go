@@ -0,0 +1,203 @@
+package cadump
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Output files compression
+const (
+	CompressionNone = "none"
+	CompressionZip  = "zip"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+const bundleManifestName = "manifest.json"
+
+// compressionExt is file extension of the compressed file
+var compressionExt = map[string]string{
+	CompressionZip:  ".zip",
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// checkCompression return error if the compression is not supported (empty is no compression)
+func checkCompression(compression string) error {
+	switch strings.ToLower(compression) {
+	case "", CompressionNone, CompressionZip, CompressionGzip, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression '%s' (use none, zip, gzip or zstd)", compression)
+	}
+}
+
+// ----- Compressed file -----
+
+// compressedFile is output file with optional compression stream.
+// ZIP archive has single entry named by the base name of the file without ".zip".
+type compressedFile struct {
+	io.Writer
+	file    *os.File
+	closers []io.Closer // compression stream first, file last
+}
+
+// compressedFileName return path of the compressed file and name of the data inside
+func compressedFileName(filePath string, compression string) (fileName string, entryName string) {
+	ext, ok := compressionExt[strings.ToLower(compression)]
+	if !ok {
+		return filePath, filepath.Base(filePath)
+	}
+
+	if strings.HasSuffix(filePath, ext) {
+		return filePath, filepath.Base(strings.TrimSuffix(filePath, ext))
+	}
+	return filePath + ext, filepath.Base(filePath)
+}
+
+// createCompressedFile create file of compressedFileName and open compression stream over it
+func createCompressedFile(fileName string, entryName string, compression string) (*compressedFile, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var stream io.Writer = file
+	var closer io.Closer
+
+	switch strings.ToLower(compression) {
+	case CompressionZip:
+		zipWriter := zip.NewWriter(file)
+		stream, err = zipWriter.Create(entryName)
+		closer = zipWriter
+	case CompressionGzip:
+		gzipWriter := gzip.NewWriter(file)
+		gzipWriter.Name = entryName
+		stream, closer = gzipWriter, gzipWriter
+	case CompressionZstd:
+		var zstdWriter *zstd.Encoder
+		zstdWriter, err = zstd.NewWriter(file)
+		stream, closer = zstdWriter, zstdWriter
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(fileName)
+		return nil, err
+	}
+
+	out := &compressedFile{Writer: stream, file: file}
+	if closer != nil {
+		out.closers = append(out.closers, closer)
+	}
+	out.closers = append(out.closers, file)
+	return out, nil
+}
+
+// openAppendFile open uncompressed file for writing from the offset, data after the offset is removed.
+// The file is created if it doesn't exist.
+func openAppendFile(fileName string, offset int64) (*compressedFile, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(offset); err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &compressedFile{Writer: file, file: file, closers: []io.Closer{file}}, nil
+}
+
+// offset return size of the data written to the uncompressed file, compressed file can't be continued
+func (out *compressedFile) offset() (int64, error) {
+	if len(out.closers) > 1 {
+		return 0, fmt.Errorf("compressed file '%s' has no offset", out.file.Name())
+	}
+	return out.file.Seek(0, io.SeekCurrent)
+}
+
+// Close flush compression stream and close the file
+func (out *compressedFile) Close() error {
+	var err error
+	for _, closer := range out.closers {
+		if cerr := closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ----- Bundle -----
+
+// BundleFiles pack files into single ZIP archive with the manifest entry.
+// Entries are named by the base names of the files, partial archive is removed on error.
+func BundleFiles(ctx context.Context, bundlePath string, files []string, manifest Manifest) (err error) {
+	out, err := os.Create(bundlePath)
+	if err != nil {
+		return fmt.Errorf("create bundle '%s' error: %s", bundlePath, err)
+	}
+
+	zipWriter := zip.NewWriter(out)
+	defer func() {
+		if cerr := zipWriter.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close bundle '%s' error: %s", bundlePath, cerr)
+		}
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close bundle '%s' error: %s", bundlePath, cerr)
+		}
+		if err != nil {
+			os.Remove(bundlePath)
+		}
+	}()
+
+	for _, file := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = bundleFile(zipWriter, file); err != nil {
+			return fmt.Errorf("add file '%s' to bundle '%s' error: %s", file, bundlePath, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("serialize bundle manifest error: %s", err)
+	}
+
+	entry, err := zipWriter.Create(bundleManifestName)
+	if err == nil {
+		_, err = entry.Write(data)
+	}
+	if err != nil {
+		return fmt.Errorf("add manifest to bundle '%s' error: %s", bundlePath, err)
+	}
+	return nil
+}
+
+// bundleFile copy file into the new archive entry
+func bundleFile(zipWriter *zip.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry, err := zipWriter.Create(filepath.Base(filePath))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
@@ -0,0 +1,74 @@
+package cadump_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"cadump/cadump"
+)
+
+// ----- Tests -----
+
+func TestCSVWriter_Gzip(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-compress")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	writer, err := cadump.NewCSVWriter(filepath.Join(tmpFolder, "counts.csv"), cadump.CompressionGzip)
+	ok(t, err)
+	equals(t, filepath.Join(tmpFolder, "counts.csv.gz"), writer.FileName())
+	ok(t, writer.Write([]cadump.HotelCounts{testHCount1}))
+	ok(t, writer.Close())
+
+	file, err := os.Open(writer.FileName())
+	ok(t, err)
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	ok(t, err)
+	equals(t, "counts.csv", reader.Name)
+
+	data, err := ioutil.ReadAll(reader)
+	ok(t, err)
+	equals(t, "Hotel name,Hotel Code,CI date\nBeverly Hills,BH-19210,31/12/2018\n", string(data))
+}
+
+func TestJSONLWriter_Zstd(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-compress")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	writer, err := cadump.NewJSONLWriter(filepath.Join(tmpFolder, "counts.jsonl"), cadump.CompressionZstd)
+	ok(t, err)
+	equals(t, filepath.Join(tmpFolder, "counts.jsonl.zst"), writer.FileName())
+	ok(t, writer.Write([]cadump.HotelCounts{testHCount1}))
+	ok(t, writer.Close())
+
+	file, err := os.Open(writer.FileName())
+	ok(t, err)
+	defer file.Close()
+
+	reader, err := zstd.NewReader(file)
+	ok(t, err)
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	ok(t, err)
+	equals(t, `{"Hotel name":"Beverly Hills","Hotel Code":"BH-19210","CI date":"31/12/2018"}`+"\n", string(data))
+}
+
+func TestNewCSVWriter_UnknownCompression(t *testing.T) {
+	_, err := cadump.NewCSVWriter(filepath.Join(os.TempDir(), "counts.csv"), "rar")
+	equals(t, "unknown compression 'rar' (use none, zip, gzip or zstd)", err.Error())
+}
+
+func TestConfig_FileCompression(t *testing.T) {
+	equals(t, cadump.CompressionNone, cadump.Config{}.FileCompression())
+	equals(t, cadump.CompressionZip, cadump.Config{CompressCSV: true}.FileCompression())
+	equals(t, cadump.CompressionZstd, cadump.Config{CompressCSV: true, Compression: "ZSTD"}.FileCompression())
+}
@@ -3,7 +3,13 @@ package cadump
 import (
 	"fmt"
 	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/gocql/gocql"
+	"github.com/scylladb/gocqlx/qb"
 	"gopkg.in/yaml.v2"
 )
 
@@ -12,35 +18,524 @@ import (
 const configExample = `
 TMP_FOLDER: /tmp
 REMOVE_TMP_FILES: true
-COMPRESS_CSV: true
+COMPRESSION: gzip # CSV and JSONL files only, rooms parquet and hotels counts xlsx are not compressed
+BUNDLE: false
+LENIENT: true
+MAX_REJECTS_PERCENT: 1.5
+SKIP_ROOMS_SORT: false
+SORT_CHUNK_SIZE: 100000
+WORKERS: 4
+# CHECKPOINT_ROWS: 100000 # requires SKIP_ROOMS_SORT: true, csv or jsonl rooms and no COMPRESSION
+LOG:
+    level: INFO
+    format: json
+    file: /var/log/cadump.log
+CHANNELS:
+  - Marriott
+  - Booking
+  - Expedia
+  - Ctrip
+  - Priceline
+
+EXTRA_COLUMNS:
+  - name: Cancellation policy
+    ext_data: cancellation_policy
+  - name: Tax inclusive
+    ext_data: tax_inclusive
+    row: true
+  - name: Snapshots
+    field: snapshot_url
+
+OUTPUT:
+    rooms: parquet
+    hotels_counts: xlsx
+
+FILTER:
+    hotel_codes:
+      - HTL001
+      - HTL002
+    channels:
+      - Marriott
+    ci_from: today
+    ci_to: +30
+    los:
+      - 1
+      - 7
 
 CASSANDRA:
     hosts:
       - cassandra-host1
       - cassandra-host2
+    port: 9042
     keyspace: some_key_space
+    protocol_version: 4
+    username: cadump
+    password: pass
+    tls: true
+    tls_ca_file: /etc/cadump/ca.pem
+    local_dc: dc1
+    consistency: LOCAL_QUORUM
+    timeout: 60s
+    connect_timeout: 10s
+    connect_retries: 5
+    query_retries: 3
+    query_retry_delay: 1s
+    page_size: 1000
+    range_splits: 8
+    split_column: ci_date
+    push_filters: true
+    schema:
+        table: scan_data
+        scan_id_column: aux_data_scan_id
+        columns:
+            aux_data_name: hotel_name
+        ext_data:
+            room_name: room_title
+
+METRICS:
+    listen: :9100
+    pushgateway: http://pushgateway:9091
+    job: cadump
+
+WATCH:
+    table: scans
+    column: scan_id
+    where:
+        status: finished
+    allow_filtering: true
+    interval: 1m
+    state_file: /var/lib/cadump/watch.json
+    min_scan_id: 90000
+    max_attempts: 5
 
 FTP: 
     host: files.net
+    port: 21
     user: user
     password: pass 
+    tls: explicit
+    remote_dir: upload/cadump
+    atomic_rename: true
+    retries: 5
+    retry_delay: 1s
+
+DESTINATIONS:
+  - type: sftp
+    host: sftp.files.net
+    port: 22
+    user: user
+    key_file: /home/user/.ssh/id_rsa
+    known_hosts: /home/user/.ssh/known_hosts
+    remote_dir: /upload/cadump
+    atomic_rename: true
+  - type: s3
+    endpoint: https://s3.amazonaws.com
+    region: us-east-1
+    bucket: exports
+    prefix: cadump
+    access_key: AKIA...
+    secret_key: secret
+  - type: local
+    path: /mnt/exports
+  - type: http
+    url: https://files.net/upload
+    method: PUT
+    headers:
+      Authorization: Bearer token
 `
 
 type Config struct {
 	TMPFolder      string `yaml:"TMP_FOLDER"`
 	RemoveTMPFiles bool   `yaml:"REMOVE_TMP_FILES"`
-	CompressCSV    bool   `yaml:"COMPRESS_CSV"`
+	CompressCSV    bool   `yaml:"COMPRESS_CSV"` // deprecated, same as COMPRESSION: zip
+	SkipRoomsSort  bool   `yaml:"SKIP_ROOMS_SORT"`
+	SortChunkSize  int    `yaml:"SORT_CHUNK_SIZE"`
+	Workers        int    `yaml:"WORKERS"`
+
+	// save resumable progress of the scans every number of rows, 0 disables checkpoints.
+	// Rooms files are continued from the checkpoint, so they must be unsorted and uncompressed CSV or JSONL.
+	CheckpointRows int `yaml:"CHECKPOINT_ROWS"`
+
+	// additional rooms columns from ext_data or scan_data fields
+	ExtraColumns []ExtraColumnConfig `yaml:"EXTRA_COLUMNS"`
+
+	// none, zip, gzip or zstd compression of CSV and JSONL files (rejects too), Parquet and XLSX files
+	// are written as is with own internal compression and no codec extension
+	Compression string `yaml:"COMPRESSION"`
+	// pack all files of the run into single ZIP archive with manifest
+	Bundle bool `yaml:"BUNDLE"`
+
+	// skip rows which can't be parsed and save them into rejects file instead of failing the scan
+	Lenient bool `yaml:"LENIENT"`
+	// fail the run if rejected rows exceed the percentage of all rows (0 is no limit)
+	MaxRejectsPercent float64 `yaml:"MAX_REJECTS_PERCENT"`
+
+	Log LogConfig `yaml:"LOG"`
+
+	// ordered hotels counts columns, other channels are counted in "Other" column
+	Channels []string `yaml:"CHANNELS"`
+
+	Output OutputConfig `yaml:"OUTPUT"`
+	Filter FilterConfig `yaml:"FILTER"`
+
+	Cassandra CassandraConfig `yaml:"CASSANDRA"`
+	Watch     WatchConfig     `yaml:"WATCH"`
+	Metrics   MetricsConfig   `yaml:"METRICS"`
+
+	FTP          DestinationConfig   `yaml:"FTP"`
+	Destinations []DestinationConfig `yaml:"DESTINATIONS"`
+}
+
+// FileCompression return compression of the output files, COMPRESS_CSV is used if COMPRESSION not set
+func (cfg Config) FileCompression() string {
+	switch {
+	case cfg.Compression != "":
+		return strings.ToLower(cfg.Compression)
+	case cfg.CompressCSV:
+		return CompressionZip
+	default:
+		return CompressionNone
+	}
+}
+
+// checkCheckpoints return error if the rooms files can't be continued from the checkpoint:
+// sorted rooms are written after the whole scan is read, compressed and Parquet or XLSX files
+// can't be continued from the middle
+func (cfg Config) checkCheckpoints() error {
+	if cfg.CheckpointRows <= 0 {
+		return nil
+	}
+	if !cfg.SkipRoomsSort {
+		return fmt.Errorf("CHECKPOINT_ROWS requires SKIP_ROOMS_SORT: true")
+	}
+	if format := strings.ToLower(cfg.Output.Rooms); format != "" && format != FormatCSV && format != FormatJSONL {
+		return fmt.Errorf("CHECKPOINT_ROWS requires csv or jsonl OUTPUT rooms format, not '%s'", cfg.Output.Rooms)
+	}
+	if cfg.FileCompression() != CompressionNone && !cfg.Bundle {
+		return fmt.Errorf("CHECKPOINT_ROWS requires COMPRESSION: none (files are compressed by BUNDLE)")
+	}
+	return nil
+}
+
+// LogConfig is log settings: level (DEBUG, INFO, WARNING, ERROR), text or json format and
+// output file (stderr if not set)
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	File   string `yaml:"file"`
+}
+
+// OutputConfig is file format of every output: csv (default), jsonl, parquet or xlsx
+type OutputConfig struct {
+	Rooms        string `yaml:"rooms"`
+	HotelsCounts string `yaml:"hotels_counts"`
+}
+
+// Format return file format of the output
+func (output OutputConfig) Format(name string) string {
+	switch name {
+	case OutputRooms:
+		return output.Rooms
+	case OutputHotelsCounts:
+		return output.HotelsCounts
+	default:
+		return ""
+	}
+}
+
+// CassandraConfig is Cassandra connection and read settings
+type CassandraConfig struct {
+	Hosts    []string `yaml:"hosts"`
+	Port     int      `yaml:"port"` // default 9042
+	Keyspace string   `yaml:"keyspace"`
+	PageSize int      `yaml:"page_size"`
+
+	// read consistency level (default ONE), query and connect timeouts (default 300s and driver default)
+	Consistency    string        `yaml:"consistency"`
+	Timeout        time.Duration `yaml:"timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+
+	// connect retries (default 5, first delay 2s) and failed query page retries (default 3, first delay 1s),
+	// delay doubles after every attempt
+	ConnectRetries    int           `yaml:"connect_retries"`
+	ConnectRetryDelay time.Duration `yaml:"connect_retry_delay"`
+	QueryRetries      int           `yaml:"query_retries"`
+	QueryRetryDelay   time.Duration `yaml:"query_retry_delay"`
+
+	// native protocol version, detected on connect if not set
+	ProtocolVersion int `yaml:"protocol_version"`
 
-	Cassandra struct {
-		Hosts    []string `yaml:"hosts"`
-		Keyspace string   `yaml:"keyspace"`
-	} `yaml:"CASSANDRA"`
+	// PasswordAuthenticator credentials
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 
-	FTP struct {
-		Host     string `yaml:"host"`
-		User     string `yaml:"user"`
-		Password string `yaml:"password"`
-	} `yaml:"FTP"`
+	// TLS connection, client certificate and key are optional (set both for mutual TLS),
+	// server certificate is verified with the CA file or system CAs
+	TLS           bool   `yaml:"tls"`
+	TLSCertFile   string `yaml:"tls_cert_file"`
+	TLSKeyFile    string `yaml:"tls_key_file"`
+	TLSCAFile     string `yaml:"tls_ca_file"`
+	TLSSkipVerify bool   `yaml:"tls_skip_verify"`
+
+	// route queries to the token replicas in the local datacenter, remote hosts are used only if local are down
+	LocalDC string `yaml:"local_dc"`
+
+	// names of the scan_data table, its columns and ext_data keys
+	Schema SchemaConfig `yaml:"schema"`
+
+	// split single scan query into concurrent sub-queries of the split column ranges,
+	// split column must be set: the first clustering column of the table, date or timestamp (ci_date or co_date)
+	RangeSplits int    `yaml:"range_splits"`
+	SplitColumn string `yaml:"split_column"`
+
+	// add check-in dates filter to the scan_data query (with ALLOW FILTERING),
+	// ci_date must be a clustering column or Cassandra must support filtering by regular columns
+	PushFilters bool `yaml:"push_filters"`
+}
+
+// SchemaConfig map the default scan_data table, scan ID (partition key) column, ScanDataTable columns
+// and ext_data keys read by ExtractRooms to the names used by the cluster.
+// Columns and ext_data keys are mapped from the default names, not mapped ones are used as is.
+type SchemaConfig struct {
+	Table        string            `yaml:"table"`
+	ScanIDColumn string            `yaml:"scan_id_column"`
+	Columns      map[string]string `yaml:"columns"`
+	ExtData      map[string]string `yaml:"ext_data"`
+}
+
+// TableName return name of the scan_data table
+func (schema SchemaConfig) TableName() string {
+	if schema.Table == "" {
+		return defaultScanDataTable
+	}
+	return schema.Table
+}
+
+// ScanIDColumnName return name of the scan ID column
+func (schema SchemaConfig) ScanIDColumnName() string {
+	if schema.ScanIDColumn == "" {
+		return defaultScanIDColumn
+	}
+	return schema.ScanIDColumn
+}
+
+// Column return name of the ScanDataTable column in the table
+func (schema SchemaConfig) Column(name string) string {
+	if column := schema.Columns[name]; column != "" {
+		return column
+	}
+	return name
+}
+
+// ExtDataKey return name of the ext_data key in the table
+func (schema SchemaConfig) ExtDataKey(name string) string {
+	if key := schema.ExtData[name]; key != "" {
+		return key
+	}
+	return name
+}
+
+// check return error if unknown column or ext_data key is mapped
+func (schema SchemaConfig) check() error {
+	columns := make(map[string]bool)
+	for _, column := range getTags(ScanDataTable{}, "cql") {
+		columns[column] = true
+	}
+	for name := range schema.Columns {
+		if !columns[name] {
+			return fmt.Errorf("unknown CASSANDRA schema column '%s'", name)
+		}
+	}
+
+	keys := make(map[string]bool)
+	for _, key := range extDataKeys {
+		keys[key] = true
+	}
+	for name := range schema.ExtData {
+		if !keys[name] {
+			return fmt.Errorf("unknown CASSANDRA schema ext_data key '%s'", name)
+		}
+	}
+	return nil
+}
+
+// checkSplitColumn return error if range splits are set without the split column or it is not a date column.
+// The split column must be the first clustering column, it is checked on the first split query.
+func checkSplitColumn(cassandra CassandraConfig) error {
+	if cassandra.RangeSplits <= 1 {
+		return nil
+	}
+	if cassandra.SplitColumn == "" {
+		return fmt.Errorf("CASSANDRA split_column must be set with range_splits (the first clustering column)")
+	}
+
+	tableType := reflect.TypeOf(ScanDataTable{})
+	for i := 0; i < tableType.NumField(); i++ {
+		field := tableType.Field(i)
+		if field.Tag.Get("cql") == cassandra.SplitColumn {
+			if field.Type != reflect.TypeOf(time.Time{}) {
+				return fmt.Errorf("CASSANDRA split_column '%s' is not date or timestamp", cassandra.SplitColumn)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown CASSANDRA split_column '%s'", cassandra.SplitColumn)
+}
+
+// ExtraColumnConfig is additional rooms column added after the default ones.
+// Value is taken from the ext_data key: product-keyed JSON map (like room_name) by default
+// or the plain value of the row with Row set. Field is the row-level scan_data column instead of ext_data
+// (e.g. snapshot_url is all snapshot URLs).
+type ExtraColumnConfig struct {
+	Name    string `yaml:"name"`
+	ExtData string `yaml:"ext_data"`
+	Row     bool   `yaml:"row"`
+	Field   string `yaml:"field"`
+}
+
+// checkExtraColumns return error if the extra column has no name or value source
+func checkExtraColumns(extraColumns []ExtraColumnConfig) error {
+	names := make(map[string]bool)
+	for _, name := range getTags(Room{}, "csv") {
+		names[name] = true
+	}
+	fields := make(map[string]bool)
+	for _, field := range getTags(ScanDataTable{}, "cql") {
+		fields[field] = true
+	}
+
+	for _, col := range extraColumns {
+		switch {
+		case col.Name == "":
+			return fmt.Errorf("EXTRA_COLUMNS name not set")
+		case names[col.Name]:
+			return fmt.Errorf("EXTRA_COLUMNS column '%s' already exists", col.Name)
+		case (col.ExtData == "") == (col.Field == ""):
+			return fmt.Errorf("EXTRA_COLUMNS column '%s' must have either ext_data or field", col.Name)
+		case col.Field != "" && !fields[col.Field]:
+			return fmt.Errorf("EXTRA_COLUMNS column '%s' has unknown field '%s'", col.Name, col.Field)
+		}
+		names[col.Name] = true
+	}
+	return nil
+}
+
+// FilterConfig select subset of the scan rooms, rooms are not filtered if nothing is set.
+// Check-in dates are YYYY-MM-DD, "today" or number of days from today ("+30", "-7"), both are inclusive.
+type FilterConfig struct {
+	HotelCodes []string `yaml:"hotel_codes"`
+	Channels   []string `yaml:"channels"` // case insensitive
+	CIFrom     string   `yaml:"ci_from"`
+	CITo       string   `yaml:"ci_to"`
+	LOS        []uint   `yaml:"los"`
+}
+
+// WatchConfig is finished scans polling settings of the watch mode.
+// Scan IDs are selected by the query or from the column of the table, where is the map of column values
+// the rows must be equal to (values are bound to the query, not concatenated into it).
+type WatchConfig struct {
+	Query          string                 `yaml:"query"`
+	Table          string                 `yaml:"table"`
+	Column         string                 `yaml:"column"`
+	Where          map[string]interface{} `yaml:"where"`
+	AllowFiltering bool                   `yaml:"allow_filtering"`
+
+	Interval    time.Duration `yaml:"interval"`
+	StateFile   string        `yaml:"state_file"`
+	MinScanID   uint          `yaml:"min_scan_id"`  // scans with lower or equal ID are ignored
+	MaxAttempts int           `yaml:"max_attempts"` // failed exports of the scan before it is skipped, default 5
+}
+
+// ScanIDsQuery return CQL query selecting IDs of the finished scans and values of its bind markers
+func (watch WatchConfig) ScanIDsQuery() (string, []interface{}, error) {
+	if watch.Query != "" {
+		return watch.Query, nil, nil
+	}
+	if watch.Table == "" {
+		return "", nil, fmt.Errorf("WATCH query or table not set")
+	}
+
+	column := watch.Column
+	if column == "" {
+		column = defaultWatchColumn
+	}
+
+	// sorted columns keep the query the same on every poll
+	columns := make([]string, 0, len(watch.Where))
+	for name := range watch.Where {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	var where []qb.Cmp
+	var values []interface{}
+	for _, name := range columns {
+		where = append(where, qb.Eq(name))
+		values = append(values, watch.Where[name])
+	}
+
+	builder := qb.Select(watch.Table).Columns(column)
+	if len(where) > 0 {
+		builder.Where(where...)
+	}
+	if watch.AllowFiltering {
+		builder.AllowFiltering()
+	}
+	query, _ := builder.ToCql()
+	return query, values, nil
+}
+
+// MetricsConfig is Prometheus metrics settings: watch mode serves metrics on the listen address,
+// one-shot export pushes them to the Pushgateway URL (job is "cadump" by default)
+type MetricsConfig struct {
+	Listen      string `yaml:"listen"`
+	Pushgateway string `yaml:"pushgateway"`
+	Job         string `yaml:"job"`
+}
+
+// DestinationConfig is upload destination settings.
+// Type is one of: ftp, sftp, s3, local, http. Used fields depend on the type.
+type DestinationConfig struct {
+	Type string `yaml:"type"`
+
+	// ftp, sftp
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	User       string `yaml:"user"`
+	Password   string `yaml:"password"`
+	KeyFile    string `yaml:"key_file"`
+	KnownHosts string `yaml:"known_hosts"`
+	RemoteDir  string `yaml:"remote_dir"`
+
+	// sftp only, host key is not checked without known_hosts only if it is set
+	InsecureIgnoreHostKey bool `yaml:"insecure_ignore_host_key"`
+
+	// ftp only
+	TLS           string `yaml:"tls"` // explicit or implicit
+	TLSSkipVerify bool   `yaml:"tls_skip_verify"`
+
+	// ftp, sftp: upload with ".part" suffix and rename after upload
+	AtomicRename bool `yaml:"atomic_rename"`
+
+	// ftp upload retries with exponential backoff, default if not set, 0 disables retries
+	Retries    *int          `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retry_delay"`
+
+	// s3
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+
+	// local
+	Path string `yaml:"path"`
+
+	// http
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
 }
 
 func LoadConfig(cnfFile string) (Config, error) {
@@ -62,6 +557,33 @@ func LoadConfig(cnfFile string) (Config, error) {
 	if len(config.Cassandra.Hosts) == 0 || config.Cassandra.Keyspace == "" {
 		return config, fmt.Errorf("missing required CASSANDRA fields\n%s", errHelp)
 	}
+	if (config.Cassandra.TLSCertFile == "") != (config.Cassandra.TLSKeyFile == "") {
+		return config, fmt.Errorf("CASSANDRA tls_cert_file and tls_key_file must be set together")
+	}
+	if config.Cassandra.Consistency != "" {
+		if _, err := gocql.ParseConsistencyWrapper(config.Cassandra.Consistency); err != nil {
+			return config, fmt.Errorf("CASSANDRA consistency error: %s", err)
+		}
+	}
+	if config.Cassandra.ProtocolVersion < 0 || config.Cassandra.ProtocolVersion > 5 {
+		return config, fmt.Errorf("unknown CASSANDRA protocol_version %d (use 1-5)", config.Cassandra.ProtocolVersion)
+	}
+	if err := config.Cassandra.Schema.check(); err != nil {
+		return config, err
+	}
+	if err := checkExtraColumns(config.ExtraColumns); err != nil {
+		return config, err
+	}
+	if err := checkSplitColumn(config.Cassandra); err != nil {
+		return config, err
+	}
+	if err := config.checkCheckpoints(); err != nil {
+		return config, err
+	}
+
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
 
 	return config, nil
 }
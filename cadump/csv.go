@@ -1,82 +1,181 @@
 package cadump
 
 import (
-	"archive/zip"
+	"context"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/gocarina/gocsv/v2"
 )
 
 // ----- CSV Writer -----
 
-func SaveToCSV(filePath string, rows interface{}) (savedFile string, err error) {
-	savedFile = filePath
+// CSVWriter is incremental CSV writer. It allows to save rows to the (compressed) CSV file
+// batch by batch without keeping all of them in memory.
+//
+// Example:
+//
+//	writer, err := NewCSVWriter("/tmp/rooms.csv", CompressionGzip)
+//	if err != nil {
+//		return err
+//	}
+//
+//	for _, rooms := range roomsBatches {
+//		if err := writer.Write(rooms); err != nil {
+//			writer.Close()
+//			return err
+//		}
+//	}
+//	return writer.Close()
+type CSVWriter struct {
+	fileName string
+
+	outFile   *compressedFile
+	csvWriter *gocsv.SafeCSVWriter
+
+	headerSaved bool
+}
+
+// NewCSVWriter create CSV file compressed with zip, gzip or zstd (none or empty compression save plain CSV).
+// Compression extension is added to the file path, archive entry is named by the base name of the path.
+func NewCSVWriter(filePath string, compression string) (*CSVWriter, error) {
+	if err := checkCompression(compression); err != nil {
+		return nil, err
+	}
 
-	outFile, err := os.Create(filePath)
+	fileName, entryName := compressedFileName(filePath, compression)
+	outFile, err := createCompressedFile(fileName, entryName, compression)
 	if err != nil {
-		err = fmt.Errorf("create CSV file '%s' error: %s", filePath, err)
-		return
+		return nil, fmt.Errorf("create CSV file '%s' error: %s", fileName, err)
 	}
 
-	defer func() {
-		if ferr := outFile.Close(); ferr != nil {
-			err = fmt.Errorf("close CSV file '%s' error: %s", filePath, ferr)
-		}
-	}()
+	return &CSVWriter{
+		fileName:  fileName,
+		outFile:   outFile,
+		csvWriter: gocsv.DefaultCSVWriter(outFile)}, nil
+}
 
-	err = gocsv.MarshalFile(rows, outFile)
+// appendCSVWriter open uncompressed CSV file and continue it from the offset, header is not saved again
+// if it is before the offset
+func appendCSVWriter(fileName string, offset int64) (*CSVWriter, error) {
+	outFile, err := openAppendFile(fileName, offset)
 	if err != nil {
-		err = fmt.Errorf("serilize rooms into CSV file '%s' error: %s", filePath, err)
-		return
+		return nil, fmt.Errorf("open CSV file '%s' error: %s", fileName, err)
 	}
 
-	return
+	return &CSVWriter{
+		fileName:    fileName,
+		outFile:     outFile,
+		csvWriter:   gocsv.DefaultCSVWriter(outFile),
+		headerSaved: offset > 0}, nil
+}
+
+// FileName return name of the file the rows are saved to
+func (writer *CSVWriter) FileName() string {
+	return writer.fileName
 }
 
-func SaveToCSVZipped(filePath string, rows interface{}) (savedFile string, err error) {
-	var originFileName, zipFileName string
+// Write append rows (slice of structs with "csv" tags or Table) to the file.
+// CSV header is saved together with the first rows batch.
+func (writer *CSVWriter) Write(rows interface{}) error {
+	var err error
 
-	if strings.HasSuffix(filePath, ".zip") {
-		originFileName = filePath[:len(filePath)-4]
-		zipFileName = filePath
+	if table, ok := rows.(Table); ok {
+		err = writer.writeTable(table)
+	} else if writer.headerSaved {
+		err = gocsv.MarshalCSVWithoutHeaders(rows, writer.csvWriter)
 	} else {
-		originFileName = filePath
-		zipFileName = fmt.Sprintf("%s.zip", filePath)
+		err = gocsv.MarshalCSV(rows, writer.csvWriter)
+		writer.headerSaved = true
 	}
-	savedFile = zipFileName
 
-	outFile, err := os.Create(zipFileName)
 	if err != nil {
-		err = fmt.Errorf("create CSV ZIP file '%s' error: %s", zipFileName, err)
-		return
+		return fmt.Errorf("serilize rows into CSV file '%s' error: %s", writer.fileName, err)
 	}
+	return nil
+}
 
-	defer func() {
-		if ferr := outFile.Close(); ferr != nil {
-			err = fmt.Errorf("close CSV ZIP file '%s' error: %s", zipFileName, ferr)
+// writeTable save table records (and header with the first batch)
+func (writer *CSVWriter) writeTable(table Table) error {
+	if !writer.headerSaved {
+		if err := writer.csvWriter.Write(table.Header()); err != nil {
+			return err
 		}
-	}()
+		writer.headerSaved = true
+	}
 
-	zipWriter := zip.NewWriter(outFile)
-	defer func() {
-		if zwerr := zipWriter.Close(); zwerr != nil {
-			err = fmt.Errorf("close ZIP writer error: %s", zwerr)
+	for _, record := range table.Records() {
+		values := make([]string, len(record))
+		for i, value := range record {
+			if value != nil {
+				values[i] = fmt.Sprint(value)
+			}
 		}
-	}()
+		if err := writer.csvWriter.Write(values); err != nil {
+			return err
+		}
+	}
+	writer.csvWriter.Flush()
+	return writer.csvWriter.Error()
+}
 
-	fileWriter, err := zipWriter.Create(originFileName)
+// Offset flush written rows and return size of the uncompressed file
+func (writer *CSVWriter) Offset() (int64, error) {
+	writer.csvWriter.Flush()
+	if err := writer.csvWriter.Error(); err != nil {
+		return 0, fmt.Errorf("write CSV file '%s' error: %s", writer.fileName, err)
+	}
+	offset, err := writer.outFile.offset()
 	if err != nil {
-		err = fmt.Errorf("write CSV ZIP file error: %s", err)
-		return
+		return 0, fmt.Errorf("CSV file '%s' offset error: %s", writer.fileName, err)
+	}
+	return offset, nil
+}
+
+// Close flush all data and close the file
+func (writer *CSVWriter) Close() error {
+	if err := writer.outFile.Close(); err != nil {
+		return fmt.Errorf("close CSV file '%s' error: %s", writer.fileName, err)
+	}
+	return nil
+}
+
+// ----- CSV Savers -----
+
+// SaveToCSV save rows into CSV file, nothing is saved if ctx is done
+func SaveToCSV(ctx context.Context, filePath string, rows interface{}) (savedFile string, err error) {
+	return saveRows(ctx, filePath, rows, CompressionNone)
+}
+
+// SaveToCSVZipped save rows into zipped CSV file, nothing is saved if ctx is done
+func SaveToCSVZipped(ctx context.Context, filePath string, rows interface{}) (savedFile string, err error) {
+	return saveRows(ctx, filePath, rows, CompressionZip)
+}
+
+// saveRows save all rows at once, partially saved file is removed on error
+func saveRows(ctx context.Context, filePath string, rows interface{}, compression string) (savedFile string, err error) {
+	if err = ctx.Err(); err != nil {
+		return filePath, err
 	}
 
-	err = gocsv.Marshal(rows, fileWriter)
+	writer, err := NewCSVWriter(filePath, compression)
 	if err != nil {
-		err = fmt.Errorf("serilize rooms into CSV ZIP file '%s' error: %s", zipFileName, err)
-		return
+		return filePath, err
 	}
+	savedFile = writer.FileName()
+
+	defer func() {
+		if cerr := writer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			os.Remove(savedFile)
+		}
+	}()
 
+	err = writer.Write(rows)
 	return
 }
@@ -0,0 +1,69 @@
+package cadump_test
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cadump/cadump"
+)
+
+// ----- Tests -----
+
+func TestCSVWriter_Batches(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-csv")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	writer, err := cadump.NewCSVWriter(filepath.Join(tmpFolder, "counts.csv"), cadump.CompressionNone)
+	ok(t, err)
+	ok(t, writer.Write([]cadump.HotelCounts{testHCount1}))
+	ok(t, writer.Write([]cadump.HotelCounts{testHCount2}))
+	ok(t, writer.Close())
+
+	data, err := ioutil.ReadFile(writer.FileName())
+	ok(t, err)
+	equals(t, "Hotel name,Hotel Code,CI date\n"+
+		"Beverly Hills,BH-19210,31/12/2018\n"+
+		"Hotel California,HC1980,10/11/2018\n", string(data))
+}
+
+func TestCSVWriter_Table(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-csv")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	agg := cadump.NewAggregator("Marriott", "Booking")
+	agg.AddRooms([]cadump.Room{Room1("Booking"), Room1("Trivago"), Room2("Marriott")})
+
+	writer, err := cadump.NewCSVWriter(filepath.Join(tmpFolder, "counts.csv"), cadump.CompressionNone)
+	ok(t, err)
+	ok(t, writer.Write(agg.HotelsCountsTable()))
+	ok(t, writer.Close())
+
+	data, err := ioutil.ReadFile(writer.FileName())
+	ok(t, err)
+	equals(t, "Hotel name,Hotel Code,CI date,Marriott,Booking,Other\n"+
+		"Beverly Hills,BH-19210,31/12/2018,0,1,1\n"+
+		"Hotel California,HC1980,10/11/2018,1,0,0\n", string(data))
+}
+
+func TestCSVWriter_Zipped(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-csv")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	writer, err := cadump.NewCSVWriter(filepath.Join(tmpFolder, "counts.csv"), cadump.CompressionZip)
+	ok(t, err)
+	equals(t, filepath.Join(tmpFolder, "counts.csv.zip"), writer.FileName())
+	ok(t, writer.Write([]cadump.HotelCounts{testHCount1, testHCount2}))
+	ok(t, writer.Close())
+
+	archive, err := zip.OpenReader(writer.FileName())
+	ok(t, err)
+	defer archive.Close()
+	equals(t, 1, len(archive.File))
+	equals(t, "counts.csv", archive.File[0].Name)
+}
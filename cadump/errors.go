@@ -0,0 +1,64 @@
+package cadump
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ----- Stage -----
+
+// Stage is the step of the export where an error happened
+type Stage string
+
+// Export stages
+const (
+	StageConfig  Stage = "config"
+	StageConnect Stage = "connect"
+	StageQuery   Stage = "query"
+	StageParse   Stage = "parse"
+	StageWrite   Stage = "write"
+	StageUpload  Stage = "upload"
+
+	// StageCanceled is set when the run is stopped by the context
+	StageCanceled Stage = "canceled"
+)
+
+// ----- Stage error -----
+
+// StageError is the error of the export stage.
+// Use ErrorStage to find out the stage of the error returned by Run.
+type StageError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Stage, e.Err)
+}
+
+// Unwrap return the original error
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// stageError wrap the error with the stage, error which already has a stage is returned as is
+func stageError(stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var se *StageError
+	if errors.As(err, &se) {
+		return err
+	}
+	return &StageError{Stage: stage, Err: err}
+}
+
+// ErrorStage return the stage of the error (false if error has no stage)
+func ErrorStage(err error) (Stage, bool) {
+	var se *StageError
+	if errors.As(err, &se) {
+		return se.Stage, true
+	}
+	return "", false
+}
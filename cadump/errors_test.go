@@ -0,0 +1,32 @@
+package cadump_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cadump/cadump"
+)
+
+// ----- Tests -----
+
+func TestErrorStage(t *testing.T) {
+	err := fmt.Errorf("no stage")
+	_, ok := cadump.ErrorStage(err)
+	equals(t, false, ok)
+
+	err = &cadump.StageError{Stage: cadump.StageUpload, Err: fmt.Errorf("connection refused")}
+	stage, ok := cadump.ErrorStage(err)
+	equals(t, true, ok)
+	equals(t, cadump.StageUpload, stage)
+	equals(t, "upload error: connection refused", err.Error())
+}
+
+func TestRun_ConfigError(t *testing.T) {
+	config := cadump.Config{Destinations: []cadump.DestinationConfig{{Type: "gopher"}}}
+
+	_, err := cadump.Run(context.Background(), config, []uint{42})
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageConfig, stage)
+	equals(t, "config error: destination #1 config error: unknown destination type 'gopher'", err.Error())
+}
@@ -0,0 +1,149 @@
+package cadump
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ----- Test hooks -----
+
+// SetClock set time of the S3 request signatures
+func (up *S3Uploader) SetClock(now func() time.Time) {
+	up.now = now
+}
+
+// SetTransport set transport of the S3 requests
+func (up *S3Uploader) SetTransport(transport http.RoundTripper) {
+	up.client.Transport = transport
+}
+
+// Sign add AWS Signature Version 4 headers to the request
+func (up *S3Uploader) Sign(req *http.Request, payloadHash string) {
+	up.sign(req, payloadHash)
+}
+
+// SetXLSXMaxRows set sheet rows limit of the XLSX writer, returned function restores the Excel limit
+func SetXLSXMaxRows(rows int) func() {
+	xlsxMaxRows = rows
+	return func() { xlsxMaxRows = 1048576 }
+}
+
+// KeyRange is the range of the split column values
+type KeyRange struct {
+	Start, End time.Time
+	Last       bool
+}
+
+// SplitKeyRange split the values between min and max into n ranges
+func SplitKeyRange(min, max time.Time, n int) []KeyRange {
+	var ranges []KeyRange
+	for _, kr := range splitKeyRange(min, max, n) {
+		ranges = append(ranges, KeyRange{Start: kr.start, End: kr.end, Last: kr.last})
+	}
+	return ranges
+}
+
+// NewRangesIter return iterator merging the ranges rows read concurrently from the position,
+// rows of the first range are delayed, so the next ranges are read before it
+func NewRangesIter(dest *ScanDataTable, ranges [][]ScanDataTable, pos ScanPosition, bufSize int) SelectIter {
+	return newRangesIter(dest, len(ranges), pos, bufSize, func(index int, pos ScanPosition) rangeSource {
+		source := &sliceSource{rows: ranges[index], read: pos.PageRows}
+		if index == 0 {
+			source.delay = time.Millisecond
+		}
+		return source
+	})
+}
+
+// sliceSource is the range query returning the rows of the slice
+type sliceSource struct {
+	rows  []ScanDataTable
+	read  int
+	delay time.Duration
+}
+
+func (source *sliceSource) Next(dest interface{}) bool {
+	if source.read >= len(source.rows) {
+		return false
+	}
+	time.Sleep(source.delay)
+	*dest.(*ScanDataTable) = source.rows[source.read]
+	source.read++
+	return true
+}
+
+func (source *sliceSource) Position() ScanPosition {
+	return ScanPosition{PageRows: source.read}
+}
+
+func (source *sliceSource) Close() error {
+	return nil
+}
+
+// TestPage is the page of the query results, fetch of the page fails after FailAt rows Fails times
+type TestPage struct {
+	Rows   []ScanDataTable
+	FailAt int
+	Fails  int
+	Opens  int
+}
+
+// NewPagedIter return iterator of the query pages from the position, failed fetch is retried without delay
+func NewPagedIter(dest *ScanDataTable, pages []*TestPage, retries int, pos ScanPosition) SelectIter {
+	return SelectIter{dest: dest, paged: &pagedIter{
+		ctx: context.Background(),
+		open: func(pageState []byte) pageIter {
+			index := 0
+			if len(pageState) > 0 {
+				index = int(pageState[0])
+			}
+			page := pages[index]
+			page.Opens++
+
+			iter := &slicePage{rows: page.Rows, failAt: -1}
+			if page.Fails > 0 {
+				page.Fails--
+				iter.failAt = page.FailAt
+			}
+			if index+1 < len(pages) {
+				iter.next = []byte{byte(index + 1)}
+			}
+			return iter
+		},
+		retries:   retries,
+		log:       LogWith(Fields{}),
+		pageState: pos.PageState,
+		skip:      pos.PageRows}}
+}
+
+// slicePage is the fetched page returning the rows of the slice, the fetch fails on the failAt row
+type slicePage struct {
+	rows   []ScanDataTable
+	failAt int
+	next   []byte
+	read   int
+	err    error
+}
+
+func (page *slicePage) StructScan(dest interface{}) bool {
+	if page.read == page.failAt {
+		page.err = fmt.Errorf("connection reset by peer")
+		return false
+	}
+	if page.read >= len(page.rows) {
+		return false
+	}
+	*dest.(*ScanDataTable) = page.rows[page.read]
+	page.read++
+	return true
+}
+
+func (page *slicePage) PageState() []byte {
+	return page.next
+}
+
+func (page *slicePage) Close() error {
+	return page.err
+}
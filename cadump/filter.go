@@ -0,0 +1,142 @@
+package cadump
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const filterDateFormat = "2006-01-02"
+
+// ----- Room filter -----
+
+// RoomFilter keep only rooms matching FilterConfig.
+// Room matches if it matches every set filter, values of the single filter are alternatives.
+// Nil filter keeps all rooms.
+type RoomFilter struct {
+	hotelCodes map[string]bool
+	channels   map[string]bool // lower case
+	los        map[uint]bool
+
+	// inclusive check-in dates range, zero date is not limited
+	ciFrom, ciTo time.Time
+}
+
+// NewRoomFilter is RoomFilter constructor, relative dates are counted from the today date.
+// Nil filter is returned if no filters are set.
+func NewRoomFilter(cfg FilterConfig, today time.Time) (*RoomFilter, error) {
+	ciFrom, err := parseFilterDate(cfg.CIFrom, today)
+	if err != nil {
+		return nil, fmt.Errorf("FILTER ci_from error: %s", err)
+	}
+	ciTo, err := parseFilterDate(cfg.CITo, today)
+	if err != nil {
+		return nil, fmt.Errorf("FILTER ci_to error: %s", err)
+	}
+	if !ciFrom.IsZero() && !ciTo.IsZero() && ciTo.Before(ciFrom) {
+		return nil, fmt.Errorf("FILTER ci_to %s is before ci_from %s",
+			ciTo.Format(filterDateFormat), ciFrom.Format(filterDateFormat))
+	}
+
+	if len(cfg.HotelCodes) == 0 && len(cfg.Channels) == 0 && len(cfg.LOS) == 0 && ciFrom.IsZero() && ciTo.IsZero() {
+		return nil, nil
+	}
+
+	filter := &RoomFilter{ciFrom: ciFrom, ciTo: ciTo}
+	if len(cfg.HotelCodes) > 0 {
+		filter.hotelCodes = make(map[string]bool)
+		for _, code := range cfg.HotelCodes {
+			filter.hotelCodes[code] = true
+		}
+	}
+	if len(cfg.Channels) > 0 {
+		filter.channels = make(map[string]bool)
+		for _, channel := range cfg.Channels {
+			filter.channels[strings.ToLower(channel)] = true
+		}
+	}
+	if len(cfg.LOS) > 0 {
+		filter.los = make(map[uint]bool)
+		for _, los := range cfg.LOS {
+			filter.los[los] = true
+		}
+	}
+	return filter, nil
+}
+
+// Match return true if the room passes the filter
+func (filter *RoomFilter) Match(room Room) bool {
+	if filter == nil {
+		return true
+	}
+	if filter.hotelCodes != nil && !filter.hotelCodes[room.HotelCode] {
+		return false
+	}
+	if filter.channels != nil && !filter.channels[strings.ToLower(room.Channel)] {
+		return false
+	}
+	if filter.los != nil && !filter.los[room.LOS] {
+		return false
+	}
+
+	ciDate := cmpDate(room.CIDate)
+	if !filter.ciFrom.IsZero() && ciDate < filter.ciFrom.Format("20060102") {
+		return false
+	}
+	if !filter.ciTo.IsZero() && ciDate > filter.ciTo.Format("20060102") {
+		return false
+	}
+	return true
+}
+
+// Filter remove not matching rooms, rooms slice is reused
+func (filter *RoomFilter) Filter(rooms []Room) []Room {
+	if filter == nil {
+		return rooms
+	}
+
+	matched := rooms[:0]
+	for _, room := range rooms {
+		if filter.Match(room) {
+			matched = append(matched, room)
+		}
+	}
+	return matched
+}
+
+// CIDateRange return inclusive check-in dates range of the filter, zero date is not limited
+func (filter *RoomFilter) CIDateRange() (from time.Time, to time.Time) {
+	if filter == nil {
+		return time.Time{}, time.Time{}
+	}
+	return filter.ciFrom, filter.ciTo
+}
+
+// ----- Helpers -----
+
+// parseFilterDate parse YYYY-MM-DD date, "today" or number of days from today ("+30", "-7").
+// Empty value is zero date.
+func parseFilterDate(value string, today time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	date := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch {
+	case value == "":
+		return time.Time{}, nil
+	case strings.ToLower(value) == "today":
+		return date, nil
+	case strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-"):
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("wrong days number '%s'", value)
+		}
+		return date.AddDate(0, 0, days), nil
+	default:
+		date, err := time.Parse(filterDateFormat, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("wrong date '%s' (use YYYY-MM-DD, today, +N or -N days)", value)
+		}
+		return date, nil
+	}
+}
@@ -0,0 +1,62 @@
+package cadump_test
+
+import (
+	"testing"
+	"time"
+
+	"cadump/cadump"
+)
+
+// ----- Tests -----
+
+func TestRoomFilter_Filter(t *testing.T) {
+	today := time.Date(2019, 1, 10, 15, 30, 0, 0, time.UTC)
+	room := rooms()[0]
+
+	for _, test := range []struct {
+		filter cadump.FilterConfig
+		match  bool
+	}{
+		{cadump.FilterConfig{HotelCodes: []string{"TGDFP", "OTHER"}}, true},
+		{cadump.FilterConfig{HotelCodes: []string{"OTHER"}}, false},
+		{cadump.FilterConfig{Channels: []string{"marriott"}}, true},
+		{cadump.FilterConfig{Channels: []string{"Booking"}}, false},
+		{cadump.FilterConfig{LOS: []uint{1, 2}}, true},
+		{cadump.FilterConfig{LOS: []uint{7}}, false},
+		{cadump.FilterConfig{CIFrom: "2019-01-18", CITo: "2019-01-18"}, true},
+		{cadump.FilterConfig{CIFrom: "today", CITo: "+8"}, true},
+		{cadump.FilterConfig{CITo: "+7d"}, false},
+		{cadump.FilterConfig{CIFrom: "2019-01-19"}, false},
+		{cadump.FilterConfig{Channels: []string{"Marriott"}, LOS: []uint{1}}, false},
+	} {
+		filter, err := cadump.NewRoomFilter(test.filter, today)
+		ok(t, err)
+		equals(t, test.match, filter.Match(room))
+
+		filtered := filter.Filter(rooms())
+		equals(t, test.match, len(filtered) == 3)
+	}
+}
+
+func TestNewRoomFilter_Empty(t *testing.T) {
+	filter, err := cadump.NewRoomFilter(cadump.FilterConfig{}, time.Now())
+	ok(t, err)
+	equals(t, (*cadump.RoomFilter)(nil), filter)
+	equals(t, rooms(), filter.Filter(rooms()))
+}
+
+func TestNewRoomFilter_Dates(t *testing.T) {
+	today := time.Date(2019, 1, 10, 15, 30, 0, 0, time.UTC)
+
+	filter, err := cadump.NewRoomFilter(cadump.FilterConfig{CIFrom: "-1", CITo: "2019-02-01"}, today)
+	ok(t, err)
+	from, to := filter.CIDateRange()
+	equals(t, time.Date(2019, 1, 9, 0, 0, 0, 0, time.UTC), from)
+	equals(t, time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC), to)
+
+	_, err = cadump.NewRoomFilter(cadump.FilterConfig{CIFrom: "18/01/2019"}, today)
+	equals(t, "FILTER ci_from error: wrong date '18/01/2019' (use YYYY-MM-DD, today, +N or -N days)", err.Error())
+
+	_, err = cadump.NewRoomFilter(cadump.FilterConfig{CIFrom: "+2", CITo: "today"}, today)
+	equals(t, "FILTER ci_to 2019-01-10 is before ci_from 2019-01-12", err.Error())
+}
@@ -1,33 +1,208 @@
 package cadump
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jlaffaye/ftp"
 )
 
-// UploadFileToFTP upload file to FTP server
-func UploadFileToFTP(filePath string, host string, user string, password string) (err error) {
-	log.Infof("Connecting to FTP %s ...", host)
+const (
+	ftpDefaultPort   = 21
+	ftpUploadRetries = 5
+	ftpRetryDelay    = 1 * time.Second
+)
 
-	conn, err := ftp.Connect(fmt.Sprintf("%s:%s", host, "21"))
-	if err != nil {
-		return fmt.Errorf("FTP '%s' open connection error: %s", host, err)
+// ----- FTP -----
+
+// FTPUploader upload files to FTP server.
+//
+// Connection can be secured with TLS: "explicit" (AUTH TLS on the plain port) or "implicit" (FTPS port).
+// Files are saved into the remote dir (created if not exists). In atomic rename mode file is uploaded
+// with ".part" suffix and renamed to the final name after upload, so pollers never see partial files.
+//
+// Uploader keeps single connection for all uploads until Close. Failed upload is retried with
+// exponential backoff over the new connection, size of the uploaded file is checked after every upload.
+type FTPUploader struct {
+	host      string
+	port      int
+	user      string
+	password  string
+	remoteDir string
+
+	tlsMode      string
+	tlsConfig    *tls.Config
+	atomicRename bool
+
+	retries    int
+	retryDelay time.Duration
+
+	conn *ftp.ServerConn
+}
+
+// NewFTPUploader is FTPUploader constructor
+func NewFTPUploader(dest DestinationConfig) (*FTPUploader, error) {
+	if dest.Host == "" {
+		return nil, fmt.Errorf("ftp destination host not set")
 	}
-	defer func() {
-		if cerr := conn.Quit(); cerr != nil {
-			err = fmt.Errorf("FTP '%s' close connection error: %s", host, cerr)
+
+	tlsMode := strings.ToLower(dest.TLS)
+	if tlsMode != "" && tlsMode != "explicit" && tlsMode != "implicit" {
+		return nil, fmt.Errorf("ftp destination tls '%s' not supported (use explicit or implicit)", dest.TLS)
+	}
+
+	port := dest.Port
+	if port == 0 {
+		port = ftpDefaultPort
+	}
+
+	retries := ftpUploadRetries
+	if dest.Retries != nil {
+		if *dest.Retries < 0 {
+			return nil, fmt.Errorf("ftp destination retries must not be negative")
 		}
-	}()
+		retries = *dest.Retries
+	}
+
+	retryDelay := dest.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = ftpRetryDelay
+	}
+
+	return &FTPUploader{
+		host:         dest.Host,
+		port:         port,
+		user:         dest.User,
+		password:     dest.Password,
+		remoteDir:    dest.RemoteDir,
+		tlsMode:      tlsMode,
+		tlsConfig:    &tls.Config{ServerName: dest.Host, InsecureSkipVerify: dest.TLSSkipVerify},
+		atomicRename: dest.AtomicRename,
+		retries:      retries,
+		retryDelay:   retryDelay}, nil
+}
+
+func (up *FTPUploader) String() string {
+	scheme := "ftp"
+	if up.tlsMode != "" {
+		scheme = "ftps"
+	}
+	return fmt.Sprintf("%s://%s@%s:%d/%s", scheme, up.user, up.host, up.port, up.remoteDir)
+}
+
+// Upload save the file on FTP server with retries (retries stop if ctx is done)
+func (up *FTPUploader) Upload(ctx context.Context, filePath string) error {
+	var err error
+	retryDelay := up.retryDelay
 
-	err = conn.Login(user, password)
+	for attempt := 0; attempt <= up.retries; attempt++ {
+		err = up.upload(ctx, filePath)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			up.disconnect()
+			return err
+		}
+		LogWith(Fields{"file": filePath, "stage": StageUpload, "destination": up.String()}).Warningf(
+			"Error upload file to FTP: %s (attempt %d of %d)", err, attempt, up.retries)
+
+		// connection state is unknown after error, reconnect on the next attempt
+		up.disconnect()
+
+		if attempt < up.retries {
+			metrics.retries.WithLabelValues("ftp").Inc()
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return err
+			}
+			retryDelay *= 2
+		}
+	}
+
+	return err
+}
+
+// Check open FTP connection (login and create remote dir), connection is reused by uploads
+func (up *FTPUploader) Check(ctx context.Context) error {
+	if up.conn != nil {
+		return nil
+	}
+	return up.connect(ctx)
+}
+
+// Close close FTP connection if it is open
+func (up *FTPUploader) Close() error {
+	if up.conn == nil {
+		return nil
+	}
+
+	err := up.conn.Quit()
+	up.conn = nil
+	if err != nil {
+		return fmt.Errorf("FTP '%s' close connection error: %s", up.host, err)
+	}
+	return nil
+}
+
+// connect open FTP connection, login and create remote dir
+func (up *FTPUploader) connect(ctx context.Context) error {
+	addr := net.JoinHostPort(up.host, strconv.Itoa(up.port))
+	log.Infof("Connecting to FTP %s ...", addr)
+
+	options := []ftp.DialOption{ftp.DialWithContext(ctx)}
+	switch up.tlsMode {
+	case "explicit":
+		options = append(options, ftp.DialWithExplicitTLS(up.tlsConfig))
+	case "implicit":
+		options = append(options, ftp.DialWithTLS(up.tlsConfig))
+	}
+
+	conn, err := ftp.Dial(addr, options...)
 	if err != nil {
-		return fmt.Errorf("FTP '%s' login error: %s", host, err)
+		return fmt.Errorf("FTP '%s' open connection error: %s", up.host, err)
+	}
+
+	if err = conn.Login(up.user, up.password); err != nil {
+		conn.Quit()
+		return fmt.Errorf("FTP '%s' login error: %s", up.host, err)
+	}
+
+	if up.remoteDir != "" {
+		if err = ftpMakeDirAll(conn, up.remoteDir); err != nil {
+			conn.Quit()
+			return fmt.Errorf("FTP '%s' create dir '%s' error: %s", up.host, up.remoteDir, err)
+		}
 	}
 
-	log.Infof("Got FTP connection to '%s'", host)
+	log.Infof("Got FTP connection to '%s'", up.host)
+	up.conn = conn
+	return nil
+}
+
+// disconnect drop current connection ignoring errors
+func (up *FTPUploader) disconnect() {
+	if up.conn != nil {
+		up.conn.Quit()
+		up.conn = nil
+	}
+}
+
+// upload save the file over current connection (connect if needed) and check its size.
+// Partially uploaded file is removed if upload is interrupted by ctx.
+func (up *FTPUploader) upload(ctx context.Context, filePath string) (err error) {
+	if up.conn == nil {
+		if err = up.connect(ctx); err != nil {
+			return err
+		}
+	}
 
 	inFile, err := os.Open(filePath)
 	if err != nil {
@@ -35,18 +210,112 @@ func UploadFileToFTP(filePath string, host string, user string, password string)
 	}
 
 	defer func() {
-		if ferr := inFile.Close(); ferr != nil {
+		if ferr := inFile.Close(); ferr != nil && err == nil {
 			err = fmt.Errorf("close file '%s' error: %s", filePath, ferr)
 		}
 	}()
 
-	fileOnFTP := filepath.Base(filePath)
-	log.Infof("Uploading file '%s' to FTP '%s'", filePath, fileOnFTP)
-	err = conn.Stor(fileOnFTP, inFile)
+	stat, err := inFile.Stat()
 	if err != nil {
-		return fmt.Errorf("upload file on FTP '%s' error: %s", host, err)
+		return fmt.Errorf("stat file '%s' error: %s", filePath, err)
 	}
 
-	log.Infof("File '%s' saved on FTP", filePath)
+	fileOnFTP := remotePath(up.remoteDir, filePath)
+	storeName := fileOnFTP
+	if up.atomicRename {
+		storeName = fileOnFTP + partSuffix
+	}
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("Uploading file to FTP '%s'", storeName)
+	err = up.conn.Stor(storeName, &contextReader{ctx: ctx, r: inFile})
+	if err != nil {
+		if ctx.Err() != nil {
+			up.conn.Delete(storeName)
+		}
+		return fmt.Errorf("upload file on FTP '%s' error: %s", up.host, err)
+	}
+
+	size, err := up.conn.FileSize(storeName)
+	if err != nil {
+		return fmt.Errorf("get size of '%s' on FTP '%s' error: %s", storeName, up.host, err)
+	}
+	if size != stat.Size() {
+		return fmt.Errorf("file '%s' on FTP '%s' has size %d, expected %d",
+			storeName, up.host, size, stat.Size())
+	}
+
+	if up.atomicRename {
+		if err = ftpRename(up.conn, storeName, fileOnFTP); err != nil {
+			return fmt.Errorf("rename file on FTP '%s' error: %s", up.host, err)
+		}
+	}
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof(
+		"File saved on FTP as '%s' (%d bytes)", fileOnFTP, size)
 	return nil
 }
+
+// UploadFileToFTP upload file to FTP server (plain FTP on the default port)
+func UploadFileToFTP(ctx context.Context, filePath string, host string, user string, password string) (err error) {
+	uploader, err := NewFTPUploader(DestinationConfig{Host: host, User: user, Password: password})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := uploader.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	return uploader.Upload(ctx, filePath)
+}
+
+// ----- Helpers -----
+
+// ftpMakeDirAll create remote dir with all parents (existing dirs are skipped)
+func ftpMakeDirAll(conn *ftp.ServerConn, dir string) error {
+	cwd, err := conn.CurrentDir()
+	if err != nil {
+		return err
+	}
+
+	if conn.ChangeDir(dir) == nil {
+		return conn.ChangeDir(cwd)
+	}
+
+	path := ""
+	if strings.HasPrefix(dir, "/") {
+		path = "/"
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" {
+			continue
+		}
+		path += part
+		if conn.ChangeDir(path) == nil {
+			// dir exists, go back to keep relative paths valid
+			if err := conn.ChangeDir(cwd); err != nil {
+				return err
+			}
+		} else if err := conn.MakeDir(path); err != nil {
+			return err
+		}
+		path += "/"
+	}
+	return nil
+}
+
+// ftpRename rename the file, replace the destination if the server does not do it itself
+func ftpRename(conn *ftp.ServerConn, from, to string) error {
+	err := conn.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+
+	if _, serr := conn.FileSize(to); serr != nil {
+		return err
+	}
+	if derr := conn.Delete(to); derr != nil {
+		return err
+	}
+	return conn.Rename(from, to)
+}
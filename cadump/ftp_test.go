@@ -0,0 +1,360 @@
+package cadump_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cadump/cadump"
+)
+
+// ----- Test FTP server ---
+
+// testFTPServer is minimal in-memory FTP server (passive mode only)
+type testFTPServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	files    map[string]string
+	dirs     map[string]bool
+	commands []string
+
+	failStor int  // number of STOR commands to fail
+	truncate bool // save only half of the uploaded data
+}
+
+func startFTPServer(t *testing.T) *testFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(t, err)
+
+	server := &testFTPServer{
+		listener: listener,
+		files:    make(map[string]string),
+		dirs:     map[string]bool{"/": true}}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *testFTPServer) Close() {
+	server.listener.Close()
+}
+
+func (server *testFTPServer) dest() cadump.DestinationConfig {
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return cadump.DestinationConfig{Type: "ftp", Host: host, Port: portNum, User: "cadump", Password: "secret"}
+}
+
+func (server *testFTPServer) file(name string) (string, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	data, exists := server.files[name]
+	return data, exists
+}
+
+// commandsLike return received commands with the prefix
+func (server *testFTPServer) commandsLike(prefix string) []string {
+	var commands []string
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, cmd := range server.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+func (server *testFTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var dataListener net.Listener
+	var renameFrom string
+	cwd := "/"
+	abs := func(name string) string {
+		if strings.HasPrefix(name, "/") {
+			return path.Clean(name)
+		}
+		return path.Join(cwd, name)
+	}
+
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	reply("220 ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i > 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+
+		server.mu.Lock()
+		server.commands = append(server.commands, line)
+		server.mu.Unlock()
+
+		switch cmd {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			if arg == "secret" {
+				reply("230 logged in")
+			} else {
+				reply("530 login incorrect")
+			}
+		case "TYPE", "NOOP":
+			reply("200 ok")
+		case "PWD":
+			reply(`257 "%s"`, cwd)
+		case "CWD":
+			server.mu.Lock()
+			exists := server.dirs[abs(arg)]
+			server.mu.Unlock()
+			if exists {
+				cwd = abs(arg)
+				reply("250 ok")
+			} else {
+				reply("550 no such dir")
+			}
+		case "MKD":
+			server.mu.Lock()
+			server.dirs[abs(arg)] = true
+			server.mu.Unlock()
+			reply(`257 "%s" created`, abs(arg))
+		case "SIZE":
+			if data, exists := server.file(abs(arg)); exists {
+				reply("213 %d", len(data))
+			} else {
+				reply("550 no such file")
+			}
+		case "DELE":
+			server.mu.Lock()
+			delete(server.files, abs(arg))
+			server.mu.Unlock()
+			reply("250 ok")
+		case "RNFR":
+			renameFrom = abs(arg)
+			reply("350 ready for RNTO")
+		case "RNTO":
+			server.mu.Lock()
+			server.files[abs(arg)] = server.files[renameFrom]
+			delete(server.files, renameFrom)
+			server.mu.Unlock()
+			reply("250 ok")
+		case "EPSV":
+			dataListener, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			_, port, _ := net.SplitHostPort(dataListener.Addr().String())
+			reply("229 Entering Extended Passive Mode (|||%s|)", port)
+		case "STOR":
+			if dataListener == nil {
+				reply("425 use EPSV first")
+				continue
+			}
+			server.mu.Lock()
+			fail := server.failStor > 0
+			if fail {
+				server.failStor--
+			}
+			server.mu.Unlock()
+			if fail {
+				dataListener.Close()
+				dataListener = nil
+				reply("451 local error in processing")
+				continue
+			}
+			dataConn, err := dataListener.Accept()
+			dataListener.Close()
+			dataListener = nil
+			if err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			reply("150 ok to send data")
+			data, _ := ioutil.ReadAll(dataConn)
+			dataConn.Close()
+
+			server.mu.Lock()
+			if server.truncate {
+				data = data[:len(data)/2]
+			}
+			server.files[abs(arg)] = string(data)
+			server.mu.Unlock()
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// ----- Tests -----
+
+func TestFTPUploader(t *testing.T) {
+	server := startFTPServer(t)
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	uploader, err := cadump.NewUploader(server.dest())
+	ok(t, err)
+	ok(t, uploader.Upload(context.Background(), filePath))
+
+	data, exists := server.file("/rooms-42.csv")
+	equals(t, true, exists)
+	equals(t, testFileContent, data)
+}
+
+func TestFTPUploader_RemoteDirAtomicRename(t *testing.T) {
+	server := startFTPServer(t)
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	dest := server.dest()
+	dest.RemoteDir = "upload/cadump"
+	dest.AtomicRename = true
+
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+	ok(t, uploader.Upload(context.Background(), filePath))
+	// second upload goes to the existing dir
+	ok(t, uploader.Upload(context.Background(), filePath))
+
+	equals(t, []string{"MKD upload", "MKD upload/cadump"}, server.commandsLike("MKD"))
+	equals(t, []string{"STOR upload/cadump/rooms-42.csv.part", "STOR upload/cadump/rooms-42.csv.part"},
+		server.commandsLike("STOR"))
+	equals(t, []string{"RNTO upload/cadump/rooms-42.csv", "RNTO upload/cadump/rooms-42.csv"},
+		server.commandsLike("RNTO"))
+
+	data, exists := server.file("/upload/cadump/rooms-42.csv")
+	equals(t, true, exists)
+	equals(t, testFileContent, data)
+
+	_, exists = server.file("/upload/cadump/rooms-42.csv.part")
+	equals(t, false, exists)
+}
+
+func TestFTPUploader_SingleConnectionRetry(t *testing.T) {
+	server := startFTPServer(t)
+	defer server.Close()
+	server.failStor = 2
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	dest := server.dest()
+	dest.RetryDelay = time.Millisecond
+
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+	ok(t, uploader.Upload(context.Background(), filePath))
+	ok(t, uploader.Upload(context.Background(), filePath))
+	ok(t, uploader.Close())
+
+	// two failed attempts reconnect, successful uploads share the connection
+	equals(t, 3, len(server.commandsLike("USER")))
+	equals(t, 4, len(server.commandsLike("STOR")))
+
+	data, exists := server.file("/rooms-42.csv")
+	equals(t, true, exists)
+	equals(t, testFileContent, data)
+}
+
+func TestFTPUploader_SizeMismatch(t *testing.T) {
+	server := startFTPServer(t)
+	defer server.Close()
+	server.truncate = true
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	retries := 1
+	dest := server.dest()
+	dest.Retries = &retries
+	dest.RetryDelay = time.Millisecond
+
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+
+	err = uploader.Upload(context.Background(), filePath)
+	equals(t, "file 'rooms-42.csv' on FTP '127.0.0.1' has size 22, expected 45", err.Error())
+	equals(t, 2, len(server.commandsLike("STOR")))
+}
+
+func TestFTPUploader_NoRetries(t *testing.T) {
+	server := startFTPServer(t)
+	defer server.Close()
+	server.truncate = true
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	retries := 0
+	dest := server.dest()
+	dest.Retries = &retries
+
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+
+	err = uploader.Upload(context.Background(), filePath)
+	equals(t, "file 'rooms-42.csv' on FTP '127.0.0.1' has size 22, expected 45", err.Error())
+	equals(t, 1, len(server.commandsLike("STOR")))
+
+	retries = -1
+	_, err = cadump.NewUploader(dest)
+	equals(t, "ftp destination retries must not be negative", err.Error())
+}
+
+func TestFTPUploader_LoginError(t *testing.T) {
+	server := startFTPServer(t)
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	dest := server.dest()
+	dest.Password = "wrong"
+	dest.RetryDelay = time.Millisecond
+
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+
+	err = uploader.Upload(context.Background(), filePath)
+	equals(t, true, strings.HasPrefix(err.Error(), "FTP '127.0.0.1' login error:"))
+}
+
+func TestNewFTPUploader_WrongTLS(t *testing.T) {
+	_, err := cadump.NewFTPUploader(cadump.DestinationConfig{Host: "files.net", TLS: "always"})
+	equals(t, "ftp destination tls 'always' not supported (use explicit or implicit)", err.Error())
+}
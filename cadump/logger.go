@@ -0,0 +1,215 @@
+package cadump
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	logFormat       = `%{color}%{time:2006-01-02 15:04:05.000} %{level:.4s} ▶ %{color:reset}%{message}`
+	logFileFormat   = `%{time:2006-01-02 15:04:05.000} %{level:.4s} ▶ %{message}`
+	logTimeFormat   = "2006-01-02T15:04:05.000Z07:00"
+	defaultLogLevel = "INFO"
+)
+
+// ----- Logger -----
+
+var log = logging.MustGetLogger("cadump")
+
+// InitLogger set up log with the level, format and output file of the config.
+// Text log to stderr is colored. Returned closer closes the log file (it does nothing for stderr).
+//
+// Example:
+//
+//	closer, err := cadump.InitLogger(cadump.LogConfig{Level: "DEBUG", Format: cadump.LogFormatJSON})
+//	if err != nil {
+//		return err
+//	}
+//	defer closer.Close()
+func InitLogger(cfg LogConfig) (io.Closer, error) {
+	level := cfg.Level
+	if level == "" {
+		level = defaultLogLevel
+	}
+	logLev, err := logging.LogLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("unknown log level '%s'", cfg.Level)
+	}
+
+	format := strings.ToLower(cfg.Format)
+	if format != "" && format != LogFormatText && format != LogFormatJSON {
+		return nil, fmt.Errorf("unknown log format '%s' (use text or json)", cfg.Format)
+	}
+
+	var out io.Writer = os.Stderr
+	var closer io.Closer = nopCloser{}
+	if cfg.File != "" {
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open log file error: %s", err)
+		}
+		out, closer = file, file
+	}
+
+	var backend logging.Backend
+	switch {
+	case format == LogFormatJSON:
+		backend = &jsonBackend{out: out}
+	case cfg.File != "":
+		backend = logging.NewBackendFormatter(
+			logging.NewLogBackend(out, "", 0), logging.MustStringFormatter(logFileFormat))
+	default:
+		backend = logging.NewBackendFormatter(
+			logging.NewLogBackend(out, "", 0), logging.MustStringFormatter(logFormat))
+	}
+
+	leveled := logging.AddModuleLevel(backend)
+	leveled.SetLevel(logLev, "")
+	log.SetBackend(leveled)
+
+	return closer, nil
+}
+
+// ----- Log fields -----
+
+// Fields is the context of the log line: scan_id, stage, file, etc.
+type Fields map[string]interface{}
+
+// FieldsLogger add fields to every log line
+type FieldsLogger struct {
+	fields Fields
+}
+
+// LogWith return logger adding the fields to the log lines
+func LogWith(fields Fields) FieldsLogger {
+	return FieldsLogger{fields: fields}
+}
+
+// With return logger with the additional fields
+func (logger FieldsLogger) With(fields Fields) FieldsLogger {
+	merged := make(Fields, len(logger.fields)+len(fields))
+	for name, value := range logger.fields {
+		merged[name] = value
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return FieldsLogger{fields: merged}
+}
+
+// Debugf log the message with DEBUG level
+func (logger FieldsLogger) Debugf(format string, args ...interface{}) {
+	logger.log(logging.DEBUG, format, args)
+}
+
+// Infof log the message with INFO level
+func (logger FieldsLogger) Infof(format string, args ...interface{}) {
+	logger.log(logging.INFO, format, args)
+}
+
+// Warningf log the message with WARNING level
+func (logger FieldsLogger) Warningf(format string, args ...interface{}) {
+	logger.log(logging.WARNING, format, args)
+}
+
+// Errorf log the message with ERROR level
+func (logger FieldsLogger) Errorf(format string, args ...interface{}) {
+	logger.log(logging.ERROR, format, args)
+}
+
+func (logger FieldsLogger) log(level logging.Level, format string, args []interface{}) {
+	if !log.IsEnabledFor(level) {
+		return
+	}
+
+	entry := logEntry{msg: fmt.Sprintf(format, args...), fields: logger.fields}
+	switch level {
+	case logging.DEBUG:
+		log.Debug(entry)
+	case logging.INFO:
+		log.Info(entry)
+	case logging.WARNING:
+		log.Warning(entry)
+	default:
+		log.Error(entry)
+	}
+}
+
+// logEntry is log message with fields, text log prints fields after the message as name=value
+type logEntry struct {
+	msg    string
+	fields Fields
+}
+
+func (entry logEntry) String() string {
+	names := make([]string, 0, len(entry.fields))
+	for name := range entry.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(entry.msg)
+	for _, name := range names {
+		fmt.Fprintf(&sb, " %s=%v", name, entry.fields[name])
+	}
+	return sb.String()
+}
+
+// ----- JSON backend -----
+
+// jsonBackend write every log record as JSON object line with time, level, msg and fields
+type jsonBackend struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (backend *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	line := map[string]interface{}{}
+
+	if len(rec.Args) == 1 {
+		if entry, ok := rec.Args[0].(logEntry); ok {
+			for name, value := range entry.fields {
+				if err, ok := value.(error); ok {
+					value = err.Error()
+				}
+				line[name] = value
+			}
+			line["msg"] = entry.msg
+		}
+	}
+	if _, ok := line["msg"]; !ok {
+		line["msg"] = rec.Message()
+	}
+	line["time"] = rec.Time.Format(logTimeFormat)
+	line["level"] = level.String()
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	_, err = backend.out.Write(append(data, '\n'))
+	return err
+}
+
+// ----- Helpers -----
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,71 @@
+package cadump_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cadump/cadump"
+)
+
+// ----- Tests -----
+
+func TestInitLogger_JSON(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-log")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	logFile := filepath.Join(tmpFolder, "cadump.log")
+	closer, err := cadump.InitLogger(cadump.LogConfig{Level: "INFO", Format: cadump.LogFormatJSON, File: logFile})
+	ok(t, err)
+	defer cadump.InitLogger(cadump.LogConfig{})
+
+	scanLog := cadump.LogWith(cadump.Fields{"scan_id": 42})
+	scanLog.Debugf("Hidden")
+	scanLog.With(cadump.Fields{"file": "rooms.csv", "stage": cadump.StageWrite}).Infof("Rooms saved: %d", 3)
+	ok(t, closer.Close())
+
+	data, err := ioutil.ReadFile(logFile)
+	ok(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	equals(t, 1, len(lines))
+
+	var line map[string]interface{}
+	ok(t, json.Unmarshal([]byte(lines[0]), &line))
+	equals(t, "Rooms saved: 3", line["msg"])
+	equals(t, "INFO", line["level"])
+	equals(t, float64(42), line["scan_id"])
+	equals(t, "rooms.csv", line["file"])
+	equals(t, "write", line["stage"])
+	_, hasTime := line["time"]
+	equals(t, true, hasTime)
+}
+
+func TestInitLogger_TextFile(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-log")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	logFile := filepath.Join(tmpFolder, "cadump.log")
+	closer, err := cadump.InitLogger(cadump.LogConfig{Level: "DEBUG", File: logFile})
+	ok(t, err)
+	defer cadump.InitLogger(cadump.LogConfig{})
+
+	cadump.LogWith(cadump.Fields{"scan_id": 42, "file": "rooms.csv"}).Debugf("Rooms saved")
+	ok(t, closer.Close())
+
+	data, err := ioutil.ReadFile(logFile)
+	ok(t, err)
+	equals(t, true, strings.HasSuffix(string(data), " DEBU ▶ Rooms saved file=rooms.csv scan_id=42\n"))
+}
+
+func TestInitLogger_Errors(t *testing.T) {
+	_, err := cadump.InitLogger(cadump.LogConfig{Level: "LOUD"})
+	equals(t, "unknown log level 'LOUD'", err.Error())
+
+	_, err = cadump.InitLogger(cadump.LogConfig{Format: "xml"})
+	equals(t, "unknown log format 'xml' (use text or json)", err.Error())
+}
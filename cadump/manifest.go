@@ -0,0 +1,69 @@
+package cadump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ----- Manifest -----
+
+// Manifest describe all files of the run, it is delivered after them to signal the run is complete
+type Manifest struct {
+	Version string         `json:"version"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	ScanIDs []uint         `json:"scan_ids"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// ManifestFile is the single file of the run
+type ManifestFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Rows    uint   `json:"rows"`
+	ScanID  uint   `json:"scan_id,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Bundle  string `json:"bundle,omitempty"` // name of the bundle the file is packed into
+}
+
+// NewManifestFile return base name, size and SHA-256 checksum of the file
+func NewManifestFile(filePath string) (ManifestFile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("read file '%s' error: %s", filePath, err)
+	}
+
+	return ManifestFile{
+		Name:   filepath.Base(filePath),
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// SaveManifest save manifest as indented JSON file
+func SaveManifest(filePath string, manifest Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("serialize manifest error: %s", err)
+	}
+
+	if err = ioutil.WriteFile(filePath, data, 0644); err != nil {
+		os.Remove(filePath)
+		return fmt.Errorf("save manifest '%s' error: %s", filePath, err)
+	}
+	return nil
+}
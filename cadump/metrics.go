@@ -0,0 +1,140 @@
+package cadump
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const (
+	metricsNamespace       = "cadump"
+	defaultMetricsJob      = "cadump"
+	metricsPushTimeout     = 30 * time.Second
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+// Stages of the export measured by cadump_stage_duration_seconds
+const (
+	metricsStageConnect = "connect"
+	metricsStageQuery   = "query"
+	metricsStageExtract = "extract"
+	metricsStageSort    = "sort"
+	metricsStageWrite   = "write"
+	metricsStageUpload  = "upload"
+)
+
+// ----- Metrics -----
+
+// exportMetrics is Prometheus collectors of the export, they are registered in own registry
+type exportMetrics struct {
+	registry *prometheus.Registry
+
+	rowsRead       *prometheus.CounterVec
+	roomsExtracted *prometheus.CounterVec
+	rowsRejected   *prometheus.CounterVec
+	bytesWritten   *prometheus.CounterVec
+	stageDuration  *prometheus.HistogramVec
+	retries        *prometheus.CounterVec
+}
+
+var metrics = newExportMetrics()
+
+func newExportMetrics() *exportMetrics {
+	scanLabels := []string{"scan_id", "channel"}
+	m := &exportMetrics{
+		registry: prometheus.NewRegistry(),
+		rowsRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "rows_read_total",
+			Help: "Number of scan_data rows read from Cassandra."}, scanLabels),
+		roomsExtracted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "rooms_extracted_total",
+			Help: "Number of rooms extracted from scan_data rows before the filter."}, scanLabels),
+		rowsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "rows_rejected_total",
+			Help: "Number of scan_data rows rejected in the lenient mode."}, scanLabels),
+		bytesWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "bytes_written_total",
+			Help: "Size of the rooms and rejects files of the scans."}, scanLabels),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "stage_duration_seconds",
+			Help:    "Duration of the export stage: connect, query, extract, sort, write, upload.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10)}, []string{"stage"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "retries_total",
+			Help: "Number of retries of Cassandra connection and FTP upload."}, []string{"target"}),
+	}
+
+	m.registry.MustRegister(m.rowsRead, m.roomsExtracted, m.rowsRejected, m.bytesWritten, m.stageDuration, m.retries)
+	return m
+}
+
+// observeStage add duration of the stage
+func (m *exportMetrics) observeStage(stage string, d time.Duration) {
+	m.stageDuration.WithLabelValues(stage).Observe(d.Seconds())
+}
+
+// addFileSize add size of the scan file to the bytes written, missing file is ignored
+func (m *exportMetrics) addFileSize(scanID uint, channel string, fileName string) {
+	if fileName == "" {
+		return
+	}
+	if stat, err := os.Stat(fileName); err == nil {
+		m.bytesWritten.WithLabelValues(scanLabel(scanID), channel).Add(float64(stat.Size()))
+	}
+}
+
+// scanLabel is scan_id label value
+func scanLabel(scanID uint) string {
+	return strconv.FormatUint(uint64(scanID), 10)
+}
+
+// ----- Expose -----
+
+// MetricsHandler return HTTP handler exposing export metrics in Prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// ServeMetrics serve export metrics on the "/metrics" path of the address until ctx is done
+func ServeMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	LogWith(Fields{"addr": addr}).Infof("Serving metrics on /metrics")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("serve metrics error: %s", err)
+	}
+	return nil
+}
+
+// PushMetrics send export metrics to the Pushgateway (replacing metrics of the job)
+func PushMetrics(cfg MetricsConfig) error {
+	job := cfg.Job
+	if job == "" {
+		job = defaultMetricsJob
+	}
+
+	client := &http.Client{Timeout: metricsPushTimeout}
+	err := push.New(cfg.Pushgateway, job).Gatherer(metrics.registry).Client(client).Push()
+	if err != nil {
+		return fmt.Errorf("push metrics to '%s' error: %s", cfg.Pushgateway, err)
+	}
+
+	LogWith(Fields{"job": job}).Infof("Metrics pushed to '%s'", cfg.Pushgateway)
+	return nil
+}
@@ -0,0 +1,161 @@
+package cadump_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cadump/cadump"
+)
+
+// ----- Test helpers -----
+
+// metricValue return value of the metric line (name with labels) from the metrics handler, 0 if not found
+func metricValue(t *testing.T, metric string) float64 {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	cadump.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, metric+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, metric+" "), 64)
+			ok(t, err)
+			return value
+		}
+	}
+	return 0
+}
+
+// failedUploader fail every upload
+type failedUploader struct{}
+
+func (up failedUploader) Upload(ctx context.Context, filePath string) error {
+	return fmt.Errorf("connection refused")
+}
+
+func (up failedUploader) String() string { return "failed" }
+func (up failedUploader) Close() error   { return nil }
+
+// ----- Tests -----
+
+func TestMetrics(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-metrics")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{4242: {scanDataRow()}}}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true}
+	_, err = cadump.Run(context.Background(), config, []uint{4242},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	ok(t, err)
+
+	server := httptest.NewServer(cadump.MetricsHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	ok(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	ok(t, err)
+
+	// counters are global, so only scan labels and metric names are checked
+	for _, metric := range []string{
+		`cadump_rows_read_total{channel="Marriott",scan_id="4242"}`,
+		`cadump_rooms_extracted_total{channel="Marriott",scan_id="4242"}`,
+		`cadump_bytes_written_total{channel="Marriott",scan_id="4242"}`,
+		`cadump_stage_duration_seconds_count{stage="write"}`,
+	} {
+		equals(t, true, strings.Contains(string(body), metric))
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	ok(t, cadump.PushMetrics(cadump.MetricsConfig{Pushgateway: gateway.URL}))
+	equals(t, "/metrics/job/cadump", path)
+	equals(t, true, len(body) > 0)
+
+	gateway.Close()
+	err := cadump.PushMetrics(cadump.MetricsConfig{Pushgateway: gateway.URL, Job: "nightly"})
+	equals(t, true, err != nil)
+	equals(t, true, strings.HasPrefix(err.Error(), "push metrics to '"+gateway.URL+"' error: "))
+}
+
+func TestMetrics_Resume(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-metrics")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	broken := scanDataRow()
+	broken.ExtData["room_name"] = "{broken"
+	scans := map[uint][]cadump.ScanDataTable{4343: {scanDataRow(), broken, scanDataRow()}}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true, Lenient: true, SkipRoomsSort: true,
+		CheckpointRows: 1}
+	extracted := `cadump_rooms_extracted_total{channel="Marriott",scan_id="4343"}`
+	rejected := `cadump_rows_rejected_total{channel="Marriott",scan_id="4343"}`
+
+	// rows are counted when they are read, before the failure
+	reader := &testResumableReader{testReader: testReader{scans: scans}, failAt: 2}
+	_, err = cadump.Run(context.Background(), config, []uint{4343},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	equals(t, true, err != nil)
+	equals(t, float64(3), metricValue(t, extracted))
+	equals(t, float64(1), metricValue(t, rejected))
+
+	// resumed run counts only rows it reads, rooms read back from the file are not counted again
+	reader.failAt = 0
+	report, err := cadump.Run(context.Background(), config, []uint{4343}, cadump.WithResume(),
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	ok(t, err)
+	equals(t, float64(report.Scans[0].Rooms), metricValue(t, extracted))
+	equals(t, float64(1), metricValue(t, rejected))
+}
+
+func TestMetrics_Filter(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-metrics")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	other := scanDataRow()
+	other.ExtData["aux_data_customer_hotel_id"] = "OTHER"
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{4545: {scanDataRow(), other}}}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true,
+		Filter: cadump.FilterConfig{HotelCodes: []string{"TGDFP"}}}
+
+	// rooms of the filtered out hotel are extracted too
+	report, err := cadump.Run(context.Background(), config, []uint{4545},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	ok(t, err)
+	equals(t, uint(3), report.Scans[0].Rooms)
+	equals(t, float64(6), metricValue(t, `cadump_rooms_extracted_total{channel="Marriott",scan_id="4545"}`))
+}
+
+func TestMetrics_UploadFailed(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-metrics")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{4444: {scanDataRow()}}}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true}
+	uploads := `cadump_stage_duration_seconds_count{stage="upload"}`
+	before := metricValue(t, uploads)
+
+	_, err = cadump.Run(context.Background(), config, []uint{4444},
+		cadump.WithReader(reader), cadump.WithUploaders(failedUploader{}), cadump.WithClock(testClock))
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageUpload, stage)
+	equals(t, before+1, metricValue(t, uploads))
+}
@@ -0,0 +1,129 @@
+package cadump
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const parquetParallel = 1
+
+// ----- Parquet -----
+
+// ParquetWriter save rows into Parquet file.
+// Schema is made from the columns of the first rows batch: strings are UTF8 byte arrays,
+// integers are INT64, pointer fields are optional columns.
+type ParquetWriter struct {
+	fileName string
+	file     source.ParquetFile
+	writer   *writer.JSONWriter
+	columns  []column
+}
+
+// NewParquetWriter is ParquetWriter constructor
+func NewParquetWriter(filePath string) (*ParquetWriter, error) {
+	file, err := local.NewLocalFileWriter(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("create Parquet file '%s' error: %s", filePath, err)
+	}
+	return &ParquetWriter{fileName: filePath, file: file}, nil
+}
+
+// FileName return name of the file the rows are saved to
+func (pw *ParquetWriter) FileName() string {
+	return pw.fileName
+}
+
+// Write append rows to the file
+func (pw *ParquetWriter) Write(rows interface{}) error {
+	columns, records, err := rowsRecords(rows)
+	if err != nil {
+		return fmt.Errorf("serilize rows into Parquet file '%s' error: %s", pw.fileName, err)
+	}
+
+	if pw.writer == nil {
+		schema, err := parquetSchema(columns)
+		if err != nil {
+			return fmt.Errorf("make Parquet schema error: %s", err)
+		}
+		pw.writer, err = writer.NewJSONWriter(schema, pw.file, parquetParallel)
+		if err != nil {
+			return fmt.Errorf("create Parquet writer '%s' error: %s", pw.fileName, err)
+		}
+		pw.columns = columns
+	}
+
+	for _, record := range records {
+		row, err := jsonRecord(pw.columns, record)
+		if err != nil {
+			return fmt.Errorf("serilize rows into Parquet file '%s' error: %s", pw.fileName, err)
+		}
+		if err = pw.writer.Write(string(row)); err != nil {
+			return fmt.Errorf("write Parquet file '%s' error: %s", pw.fileName, err)
+		}
+	}
+	return nil
+}
+
+// Close write file footer and close the file
+func (pw *ParquetWriter) Close() error {
+	var err error
+	if pw.writer != nil {
+		err = pw.writer.WriteStop()
+	}
+	if cerr := pw.file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("close Parquet file '%s' error: %s", pw.fileName, err)
+	}
+	return nil
+}
+
+// ----- Helpers -----
+
+// parquetSchema make JSON schema of parquet-go writer
+func parquetSchema(columns []column) (string, error) {
+	type schemaField struct {
+		Tag    string
+		Fields []schemaField `json:",omitempty"`
+	}
+
+	root := schemaField{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	for _, col := range columns {
+		if strings.ContainsAny(col.name, ",=") {
+			return "", fmt.Errorf("column name '%s' has ',' or '='", col.name)
+		}
+
+		var colType string
+		switch col.kind {
+		case reflect.String:
+			colType = "type=BYTE_ARRAY, convertedtype=UTF8"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			colType = "type=INT64"
+		case reflect.Float32, reflect.Float64:
+			colType = "type=DOUBLE"
+		case reflect.Bool:
+			colType = "type=BOOLEAN"
+		default:
+			return "", fmt.Errorf("column '%s' type %s not supported", col.name, col.kind)
+		}
+
+		repetition := "REQUIRED"
+		if col.optional {
+			repetition = "OPTIONAL"
+		}
+
+		root.Fields = append(root.Fields, schemaField{
+			Tag: fmt.Sprintf("name=%s, %s, repetitiontype=%s", col.name, colType, repetition)})
+	}
+
+	schema, err := json.Marshal(root)
+	return string(schema), err
+}
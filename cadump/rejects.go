@@ -0,0 +1,102 @@
+package cadump
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// ----- Rejects -----
+
+// Reject is scan_data row skipped in the lenient mode because it can't be parsed
+type Reject struct {
+	AuxDataFuid string `csv:"aux_data_fuid"`
+	Field       string `csv:"field"`
+	Error       string `csv:"error"`
+}
+
+// rejectsFile is CSV file of the rejected rows of the single scan.
+// File is created on the first reject, nothing is written in dry run.
+type rejectsFile struct {
+	basePath    string
+	compression string
+	dryRun      bool
+
+	writer *CSVWriter
+	rows   uint
+}
+
+func newRejectsFile(folder string, scanID uint, compression string, dryRun bool) *rejectsFile {
+	return &rejectsFile{
+		basePath:    filepath.Join(folder, fmt.Sprintf("rejects-%d.csv", scanID)),
+		compression: compression,
+		dryRun:      dryRun}
+}
+
+// Add append rejected row to the file
+func (file *rejectsFile) Add(reject Reject) error {
+	file.rows++
+	if file.dryRun {
+		return nil
+	}
+
+	if file.writer == nil {
+		writer, err := NewCSVWriter(file.basePath, file.compression)
+		if err != nil {
+			return fmt.Errorf("save rejects error: %s", err)
+		}
+		file.writer = writer
+	}
+
+	if err := file.writer.Write([]Reject{reject}); err != nil {
+		return fmt.Errorf("save rejects error: %s", err)
+	}
+	return nil
+}
+
+// resume continue the file of the failed run with the rows rejected before the checkpoint
+func (file *rejectsFile) resume(rows uint, offset int64) error {
+	file.rows = rows
+	if rows == 0 || file.dryRun {
+		return nil
+	}
+
+	fileName, _ := compressedFileName(file.basePath, file.compression)
+	writer, err := appendCSVWriter(fileName, offset)
+	if err != nil {
+		return fmt.Errorf("save rejects error: %s", err)
+	}
+	file.writer = writer
+	return nil
+}
+
+// offset flush written rejects and return size of the file, 0 if nothing was rejected
+func (file *rejectsFile) offset() (int64, error) {
+	if file.writer == nil {
+		return 0, nil
+	}
+
+	offset, err := file.writer.Offset()
+	if err != nil {
+		return 0, fmt.Errorf("save rejects error: %s", err)
+	}
+	return offset, nil
+}
+
+// Close close the file and return its name (empty if nothing was rejected)
+func (file *rejectsFile) Close() (string, error) {
+	if file.rows == 0 {
+		return "", nil
+	}
+
+	fileName, _ := compressedFileName(file.basePath, file.compression)
+	if file.writer == nil {
+		return fileName, nil
+	}
+
+	err := file.writer.Close()
+	file.writer = nil
+	if err != nil {
+		return fileName, fmt.Errorf("save rejects error: %s", err)
+	}
+	return fileName, nil
+}
@@ -3,8 +3,13 @@ package cadump
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
 )
 
 // ----- Room row -----
@@ -23,34 +28,70 @@ type Room struct {
 	Description string `csv:"Description"`
 	TabName     string `csv:"Tab name"`
 	Snapshot    string `csv:"Snapshot"`
+
+	// values of the config extra columns
+	Extra []string `csv:"-"`
 }
 
 func roomsSortFn(rooms []Room) func(int, int) bool {
-	// sort by: HotelName, CIDate, LOS, Channel, ProductNum
 	return func(i, j int) bool {
-		r1, r2 := rooms[i], rooms[j]
-
-		if r1.HotelName == r2.HotelName {
-			if r1.CIDate == r2.CIDate {
-				if r1.LOS == r2.LOS {
-					if r1.Channel == r2.Channel {
-						return *r1.ProductNum < *r2.ProductNum
-					}
-					return r1.Channel < r2.Channel
+		return roomLess(rooms[i], rooms[j])
+	}
+}
+
+// roomLess compare rooms by: HotelName, CIDate, LOS, Channel, ProductNum
+func roomLess(r1, r2 Room) bool {
+	if r1.HotelName == r2.HotelName {
+		if r1.CIDate == r2.CIDate {
+			if r1.LOS == r2.LOS {
+				if r1.Channel == r2.Channel {
+					return *r1.ProductNum < *r2.ProductNum
 				}
-				return r1.LOS < r2.LOS
+				return r1.Channel < r2.Channel
 			}
-			return cmpDate(r1.CIDate) < cmpDate(r2.CIDate)
+			return r1.LOS < r2.LOS
 		}
-		return r1.HotelName < r2.HotelName
+		return cmpDate(r1.CIDate) < cmpDate(r2.CIDate)
 	}
+	return r1.HotelName < r2.HotelName
 }
 
 // ----- Rooms extractor -----
 
-// ExtractRooms return array of the rooms from single DB scan row
-func ExtractRooms(scanData ScanDataTable) ([]Room, error) {
+// ext_data keys read by ExtractRooms (default names of SchemaConfig.ExtData)
+const (
+	extDataHotelCode   = "aux_data_customer_hotel_id"
+	extDataRoomName    = "room_name"
+	extDataRateName    = "rate_name"
+	extDataDescription = "description"
+	extDataTabName     = "tab_name"
+)
+
+var extDataKeys = []string{extDataHotelCode, extDataRoomName, extDataRateName, extDataDescription, extDataTabName}
+
+// RowError is the error of the scan_data row field which can't be parsed
+type RowError struct {
+	Fuid  gocql.UUID
+	Field string
+	Err   error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("[%s] field '%s' parse error: %s", e.Fuid.String(), e.Field, e.Err)
+}
+
+// Unwrap return the original error
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// ExtractRooms return array of the rooms from single DB scan row, ext_data keys are mapped by the schema.
+// Values of the extra columns are saved into Room.Extra in the same order. Parse error is *RowError.
+func ExtractRooms(scanData ScanDataTable, schema SchemaConfig, extraColumns ...ExtraColumnConfig) ([]Room, error) {
 	var rooms []Room
+	extDataField := func(name string) string {
+		return schema.Column("ext_data") + "." + schema.ExtDataKey(name)
+	}
 
 	snapshot := ""
 	if scanData.SnapshotURL != nil && len(scanData.SnapshotURL) > 0 {
@@ -59,43 +100,47 @@ func ExtractRooms(scanData ScanDataTable) ([]Room, error) {
 
 	hotel := Room{
 		HotelName: scanData.AuxDataName,
-		HotelCode: scanData.ExtData["aux_data_customer_hotel_id"],
+		HotelCode: scanData.ExtData[schema.ExtDataKey(extDataHotelCode)],
 		CIDate:    scanData.CIDate.Format("02/01/2006"),
 		LOS:       uint(scanData.CODate.Sub(scanData.CIDate).Hours() / 24),
 		Channel:   strings.Title(scanData.AuxDataProvider),
 		Currency:  strings.ToUpper(scanData.Currency),
 		Snapshot:  snapshot}
 
+	rowExtra, productExtra, err := extractExtra(scanData, schema, extraColumns)
+	if err != nil {
+		return rooms, err
+	}
+	hotel.Extra = rowExtra
+
 	if scanData.Availability == "Not available" {
 		rooms = append(rooms, hotel)
 		return rooms, nil
 	}
 
-	roomName, err := unpackExtDataField(scanData.ExtData, "room_name", false)
+	roomName, err := unpackExtDataField(scanData.ExtData, schema.ExtDataKey(extDataRoomName), false)
 	if err != nil {
-		return rooms, fmt.Errorf("[%s] ExtData 'room_name' parse error: %s",
-			scanData.AuxDataFuid.String(), err)
+		return rooms, &RowError{Fuid: scanData.AuxDataFuid, Field: extDataField(extDataRoomName), Err: err}
 	}
 
-	description, err := unpackExtDataField(scanData.ExtData, "rate_name", true)
+	description, err := unpackExtDataField(scanData.ExtData, schema.ExtDataKey(extDataRateName), true)
 	if err != nil {
-		description, err = unpackExtDataField(scanData.ExtData, "description", false)
+		description, err = unpackExtDataField(scanData.ExtData, schema.ExtDataKey(extDataDescription), false)
 		if err != nil {
-			return rooms, fmt.Errorf("[%s] ExtData 'rate_name' or 'description' parse error: %s",
-				scanData.AuxDataFuid.String(), err)
+			return rooms, &RowError{Fuid: scanData.AuxDataFuid, Field: extDataField(extDataRateName), Err: err}
 		}
 	}
 
-	tabName, err := unpackExtDataField(scanData.ExtData, "tab_name", true)
+	tabName, err := unpackExtDataField(scanData.ExtData, schema.ExtDataKey(extDataTabName), true)
 	if err != nil {
-		return rooms, fmt.Errorf("[%s] ExtData 'tab_name' parse error: %s",
-			scanData.AuxDataFuid.String(), err)
+		return rooms, &RowError{Fuid: scanData.AuxDataFuid, Field: extDataField(extDataTabName), Err: err}
 	}
 
 	for numKey := range scanData.ShownPrice {
 		prodNum, err := strToUInt(numKey)
 		if err != nil {
-			return rooms, fmt.Errorf("product number \"%s\" parse error: %s", numKey, err)
+			return rooms, &RowError{Fuid: scanData.AuxDataFuid, Field: schema.Column("shown_price"),
+				Err: fmt.Errorf("product number \"%s\" parse error: %s", numKey, err)}
 		}
 
 		room := hotel
@@ -104,13 +149,112 @@ func ExtractRooms(scanData ScanDataTable) ([]Room, error) {
 		room.RoomName = roomName[numKey]
 		room.Description = description[numKey]
 		room.TabName = tabName[numKey]
+		if len(extraColumns) > 0 {
+			room.Extra = make([]string, len(extraColumns))
+			for i := range extraColumns {
+				room.Extra[i] = rowExtra[i]
+				if productExtra[i] != nil {
+					room.Extra[i] = productExtra[i][numKey]
+				}
+			}
+		}
 
 		rooms = append(rooms, room)
 	}
 
+	// map iteration order is random, keep products in stable order
+	sort.Slice(rooms, func(i, j int) bool {
+		return *rooms[i].ProductNum < *rooms[j].ProductNum
+	})
+
 	return rooms, nil
 }
 
+// extractExtra return row values of the extra columns and product-keyed values (nil for row-level columns)
+func extractExtra(scanData ScanDataTable, schema SchemaConfig, extraColumns []ExtraColumnConfig) (
+	[]string, []map[string]string, error) {
+
+	if len(extraColumns) == 0 {
+		return nil, nil, nil
+	}
+
+	rowExtra := make([]string, len(extraColumns))
+	productExtra := make([]map[string]string, len(extraColumns))
+	for i, col := range extraColumns {
+		switch {
+		case col.Field != "":
+			rowExtra[i] = rowFieldValue(scanData, col.Field)
+		case col.Row:
+			rowExtra[i] = scanData.ExtData[col.ExtData]
+		default:
+			values, err := unpackExtDataField(scanData.ExtData, col.ExtData, true)
+			if err != nil {
+				field := schema.Column("ext_data") + "." + col.ExtData
+				return nil, nil, &RowError{Fuid: scanData.AuxDataFuid, Field: field, Err: err}
+			}
+			productExtra[i] = values
+			if productExtra[i] == nil {
+				productExtra[i] = map[string]string{}
+			}
+		}
+	}
+	return rowExtra, productExtra, nil
+}
+
+// rowFieldValue return ScanDataTable field of the column as string: lists are joined with spaces,
+// maps are JSON objects, dates are DD/MM/YYYY
+func rowFieldValue(scanData ScanDataTable, column string) string {
+	row := reflect.ValueOf(scanData)
+	for fnum := 0; fnum < row.NumField(); fnum++ {
+		if row.Type().Field(fnum).Tag.Get("cql") != column {
+			continue
+		}
+
+		switch value := row.Field(fnum).Interface().(type) {
+		case string:
+			return value
+		case []string:
+			return strings.Join(value, " ")
+		case map[string]string:
+			data, _ := json.Marshal(value)
+			return string(data)
+		case time.Time:
+			return value.Format("02/01/2006")
+		default:
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+// ----- Rooms table -----
+
+// RoomsTable is rooms with the extra columns after the Room columns
+type RoomsTable struct {
+	Extra []string // extra columns names
+	Rows  []Room
+}
+
+// Header return Room columns ("csv" tags) and extra columns
+func (table *RoomsTable) Header() []string {
+	return append(getTags(Room{}, "csv"), table.Extra...)
+}
+
+// Records return table rows: Room fields and extra values (empty if the room has no value)
+func (table *RoomsTable) Records() [][]interface{} {
+	_, records, _ := rowsRecords(table.Rows)
+	for i := range records {
+		for j := range table.Extra {
+			value := ""
+			if j < len(table.Rows[i].Extra) {
+				value = table.Rows[i].Extra[j]
+			}
+			records[i] = append(records[i], value)
+		}
+	}
+	return records
+}
+
 // ----- Helpers -----
 
 func unpackExtDataField(extData map[string]string, fieldName string, optional bool) (map[string]string, error) {
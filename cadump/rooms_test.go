@@ -2,6 +2,7 @@ package cadump_test
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
@@ -100,7 +101,7 @@ func TestExtractRooms(t *testing.T) {
 	expRooms := rooms()
 
 	sd := scanDataRow()
-	rooms, err := cadump.ExtractRooms(sd)
+	rooms, err := cadump.ExtractRooms(sd, cadump.SchemaConfig{})
 
 	ok(t, err)
 
@@ -126,7 +127,61 @@ func TestExtractRooms_NotAvailable(t *testing.T) {
 			Snapshot:  "https://s3.amazonaws.com/img/fpbs_test.png"},
 	}
 
-	rooms, err := cadump.ExtractRooms(sd)
+	rooms, err := cadump.ExtractRooms(sd, cadump.SchemaConfig{})
 	ok(t, err)
 	equals(t, expRooms, rooms)
 }
+
+func TestExtractRooms_Extra(t *testing.T) {
+	sd := scanDataRow()
+	sd.SnapshotURL = append(sd.SnapshotURL, "https://s3.amazonaws.com/img/fpbs_test_2.png")
+	sd.ExtData["meal_plan"] = json2str(map[string]string{"1": "RO", "3": "BB"})
+	sd.ExtData["tax_inclusive"] = "true"
+	extra := []cadump.ExtraColumnConfig{
+		{Name: "Meal plan", ExtData: "meal_plan"},
+		{Name: "Tax inclusive", ExtData: "tax_inclusive", Row: true},
+		{Name: "Snapshots", Field: "snapshot_url"},
+		{Name: "Cancellation", ExtData: "cancellation_policy"},
+	}
+
+	rooms, err := cadump.ExtractRooms(sd, cadump.SchemaConfig{}, extra...)
+	ok(t, err)
+	snapshots := "https://s3.amazonaws.com/img/fpbs_test.png https://s3.amazonaws.com/img/fpbs_test_2.png"
+	equals(t, []string{"RO", "true", snapshots, ""}, rooms[0].Extra)
+	equals(t, []string{"", "true", snapshots, ""}, rooms[1].Extra)
+	equals(t, []string{"BB", "true", snapshots, ""}, rooms[2].Extra)
+
+	sd.ExtData["meal_plan"] = "{broken"
+	_, err = cadump.ExtractRooms(sd, cadump.SchemaConfig{}, extra...)
+	var rowErr *cadump.RowError
+	equals(t, true, errors.As(err, &rowErr))
+	equals(t, "ext_data.meal_plan", rowErr.Field)
+}
+
+func TestExtractRooms_Schema(t *testing.T) {
+	expRooms := rooms()
+
+	sd := scanDataRow()
+	for from, to := range map[string]string{"aux_data_customer_hotel_id": "hotel_id", "room_name": "room_title"} {
+		sd.ExtData[to] = sd.ExtData[from]
+		delete(sd.ExtData, from)
+	}
+	schema := cadump.SchemaConfig{ExtData: map[string]string{
+		"aux_data_customer_hotel_id": "hotel_id", "room_name": "room_title"}}
+
+	rooms, err := cadump.ExtractRooms(sd, schema)
+	ok(t, err)
+	for i := range rooms {
+		equals(t, *rooms[i].ProductNum, *expRooms[i].ProductNum)
+		rooms[i].ProductNum = expRooms[i].ProductNum
+	}
+	equals(t, expRooms, rooms)
+
+	// error has the mapped field name
+	sd.ExtData["room_title"] = "{broken"
+	schema.Columns = map[string]string{"ext_data": "extra"}
+	_, err = cadump.ExtractRooms(sd, schema)
+	var rowErr *cadump.RowError
+	equals(t, true, errors.As(err, &rowErr))
+	equals(t, "extra.room_title", rowErr.Field)
+}
@@ -0,0 +1,232 @@
+package cadump
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const (
+	defaultSortChunkSize = 100000
+	mergeBatchSize       = 1000
+)
+
+// ----- Rooms external sort -----
+
+// RoomSorter is external merge sort for rooms.
+// Rooms are collected in memory chunks, every full chunk is sorted and spilled
+// to the temp file. Merge reads all chunks back and returns rooms in sorted order.
+//
+// Example:
+//
+//	sorter := NewRoomSorter("/tmp", 100000)
+//	defer sorter.Close()
+//
+//	if err := sorter.Add(rooms); err != nil {
+//		return err
+//	}
+//	return sorter.Merge(func(sorted []Room) error {
+//		return writer.Write(sorted)
+//	})
+type RoomSorter struct {
+	tmpFolder string
+	chunkSize int
+
+	chunk      []Room
+	chunkFiles []string
+}
+
+// NewRoomSorter is RoomSorter constructor
+func NewRoomSorter(tmpFolder string, chunkSize int) *RoomSorter {
+	if chunkSize <= 0 {
+		chunkSize = defaultSortChunkSize
+	}
+	return &RoomSorter{tmpFolder: tmpFolder, chunkSize: chunkSize}
+}
+
+// Add collect rooms and spill the chunk to the temp file when it is full
+func (sorter *RoomSorter) Add(rooms []Room) error {
+	for _, room := range rooms {
+		sorter.chunk = append(sorter.chunk, room)
+		if len(sorter.chunk) >= sorter.chunkSize {
+			if err := sorter.spill(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Merge pass all collected rooms to the fn in sorted order by batches
+func (sorter *RoomSorter) Merge(fn func([]Room) error) error {
+	if len(sorter.chunkFiles) == 0 {
+		// everything fits in memory
+		sort.Slice(sorter.chunk, roomsSortFn(sorter.chunk))
+		for start := 0; start < len(sorter.chunk); start += mergeBatchSize {
+			end := start + mergeBatchSize
+			if end > len(sorter.chunk) {
+				end = len(sorter.chunk)
+			}
+			if err := fn(sorter.chunk[start:end]); err != nil {
+				return err
+			}
+		}
+		sorter.chunk = nil
+		return nil
+	}
+
+	if len(sorter.chunk) > 0 {
+		if err := sorter.spill(); err != nil {
+			return err
+		}
+	}
+
+	var chunks roomChunksHeap
+	for _, chunkFile := range sorter.chunkFiles {
+		chunk, err := openRoomChunk(chunkFile)
+		if err != nil {
+			return err
+		}
+		defer chunk.close()
+
+		ok, err := chunk.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			chunks = append(chunks, chunk)
+		}
+	}
+	heap.Init(&chunks)
+
+	batch := make([]Room, 0, mergeBatchSize)
+	for chunks.Len() > 0 {
+		chunk := chunks[0]
+		batch = append(batch, chunk.room)
+
+		ok, err := chunk.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&chunks, 0)
+		} else {
+			heap.Pop(&chunks)
+		}
+
+		if len(batch) == mergeBatchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+// Close remove all temp chunk files
+func (sorter *RoomSorter) Close() error {
+	var err error
+	for _, chunkFile := range sorter.chunkFiles {
+		if rerr := os.Remove(chunkFile); rerr != nil && err == nil {
+			err = fmt.Errorf("remove sort chunk '%s' error: %s", chunkFile, rerr)
+		}
+	}
+	sorter.chunkFiles = nil
+	sorter.chunk = nil
+	return err
+}
+
+// spill sort current chunk and save it to the temp file
+func (sorter *RoomSorter) spill() (err error) {
+	sort.Slice(sorter.chunk, roomsSortFn(sorter.chunk))
+
+	outFile, err := ioutil.TempFile(sorter.tmpFolder, "rooms-chunk-")
+	if err != nil {
+		return fmt.Errorf("create sort chunk file error: %s", err)
+	}
+	sorter.chunkFiles = append(sorter.chunkFiles, outFile.Name())
+
+	LogWith(Fields{"file": outFile.Name()}).Debugf("Spill %d sorted rooms", len(sorter.chunk))
+
+	defer func() {
+		if ferr := outFile.Close(); ferr != nil && err == nil {
+			err = fmt.Errorf("close sort chunk file '%s' error: %s", outFile.Name(), ferr)
+		}
+	}()
+
+	buf := bufio.NewWriter(outFile)
+	encoder := json.NewEncoder(buf)
+	for _, room := range sorter.chunk {
+		if err = encoder.Encode(room); err != nil {
+			return fmt.Errorf("write sort chunk file '%s' error: %s", outFile.Name(), err)
+		}
+	}
+	if err = buf.Flush(); err != nil {
+		return fmt.Errorf("write sort chunk file '%s' error: %s", outFile.Name(), err)
+	}
+
+	sorter.chunk = sorter.chunk[:0]
+	return nil
+}
+
+// ----- Sorted chunk reader -----
+
+type roomChunk struct {
+	file    *os.File
+	decoder *json.Decoder
+	room    Room
+}
+
+func openRoomChunk(chunkFile string) (*roomChunk, error) {
+	inFile, err := os.Open(chunkFile)
+	if err != nil {
+		return nil, fmt.Errorf("open sort chunk file '%s' error: %s", chunkFile, err)
+	}
+	return &roomChunk{file: inFile, decoder: json.NewDecoder(bufio.NewReader(inFile))}, nil
+}
+
+// next read the next room from the chunk, return false when chunk is over
+func (chunk *roomChunk) next() (bool, error) {
+	// decode into the new room every time, absent fields must stay empty
+	var room Room
+	err := chunk.decoder.Decode(&room)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read sort chunk file '%s' error: %s", chunk.file.Name(), err)
+	}
+	chunk.room = room
+	return true, nil
+}
+
+func (chunk *roomChunk) close() {
+	if err := chunk.file.Close(); err != nil {
+		LogWith(Fields{"file": chunk.file.Name()}).Warningf("Close sort chunk file error: %s", err)
+	}
+}
+
+// roomChunksHeap is min-heap of chunks by their current room
+type roomChunksHeap []*roomChunk
+
+func (h roomChunksHeap) Len() int            { return len(h) }
+func (h roomChunksHeap) Less(i, j int) bool  { return roomLess(h[i].room, h[j].room) }
+func (h roomChunksHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *roomChunksHeap) Push(x interface{}) { *h = append(*h, x.(*roomChunk)) }
+func (h *roomChunksHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
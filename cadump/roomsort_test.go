@@ -0,0 +1,71 @@
+package cadump_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"cadump/cadump"
+)
+
+// ----- Test vars ---
+
+func unsortedRooms() []cadump.Room {
+	var rooms []cadump.Room
+
+	hotels := []string{"Hotel California", "Beverly Hills", "Dubrova house", "AbuDabi hotel"}
+	dates := []string{"10/11/2018", "31/12/2018", "01/01/2019"}
+	for i := 0; i < 30; i++ {
+		prodNum := uint(i % 4)
+		rooms = append(rooms, cadump.Room{
+			HotelName:  hotels[i%len(hotels)],
+			CIDate:     dates[i%len(dates)],
+			LOS:        uint(i % 2),
+			Channel:    "Marriott",
+			ProductNum: &prodNum})
+	}
+	return rooms
+}
+
+func sortRooms(t *testing.T, chunkSize int, rooms []cadump.Room) []cadump.Room {
+	var sorted []cadump.Room
+
+	tmpFolder, err := ioutil.TempDir("", "cadump-sort")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	sorter := cadump.NewRoomSorter(tmpFolder, chunkSize)
+	ok(t, sorter.Add(rooms[:10]))
+	ok(t, sorter.Add(rooms[10:]))
+	ok(t, sorter.Merge(func(batch []cadump.Room) error {
+		sorted = append(sorted, batch...)
+		return nil
+	}))
+	ok(t, sorter.Close())
+
+	files, err := ioutil.ReadDir(tmpFolder)
+	ok(t, err)
+	equals(t, 0, len(files))
+
+	return sorted
+}
+
+// ----- Tests -----
+
+func TestRoomSorter_InMemory(t *testing.T) {
+	rooms := unsortedRooms()
+	sorted := sortRooms(t, 100, rooms)
+
+	equals(t, len(rooms), len(sorted))
+	for i := 1; i < len(sorted); i++ {
+		r1, r2 := sorted[i-1], sorted[i]
+		equals(t, true, r1.HotelName <= r2.HotelName)
+	}
+}
+
+func TestRoomSorter_ExternalMerge(t *testing.T) {
+	rooms := unsortedRooms()
+
+	// 7 rooms per chunk makes 5 spilled chunks
+	equals(t, sortRooms(t, 100, rooms), sortRooms(t, 7, rooms))
+}
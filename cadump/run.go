@@ -0,0 +1,945 @@
+package cadump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const timestampFormat = "2006_01_02-15_04_05"
+
+// ----- Dependencies -----
+
+// ScanReader read rows of the scan from the storage, CassandraReader is the default one
+type ScanReader interface {
+	SelectScanData(ctx context.Context, scanID uint, dest *ScanDataTable) (ScanIter, error)
+	Close()
+}
+
+// FilterReader is ScanReader which can skip rows not matching the filter on the storage side.
+// Rows are filtered by Run anyway, so the reader may return rows which don't match.
+type FilterReader interface {
+	SelectFilteredScanData(ctx context.Context, scanID uint, filter *RoomFilter, dest *ScanDataTable) (ScanIter, error)
+}
+
+// ScanIter iterate over selected rows, every Next call fills the select dest
+type ScanIter interface {
+	Next() bool
+	Close() error
+}
+
+// ResumableReader is ScanReader which can continue the filtered scan query from the position
+// of the previous query, it is required by checkpoints
+type ResumableReader interface {
+	SelectScanDataFrom(ctx context.Context, scanID uint, filter *RoomFilter, pos ScanPosition,
+		dest *ScanDataTable) (ResumableIter, error)
+}
+
+// ResumableIter is ScanIter returning the query position after the last returned row
+type ResumableIter interface {
+	ScanIter
+	Position() ScanPosition
+}
+
+// ----- Run options -----
+
+// Option replace default dependency of Run.
+// Injected reader and uploaders are not closed by Run, caller owns them.
+type Option func(run *runner)
+
+// WithReader set scan rows reader instead of CassandraReader created from config
+func WithReader(reader ScanReader) Option {
+	return func(run *runner) {
+		run.reader = reader
+	}
+}
+
+// WithWriter set files writer instead of ones of the config output formats
+func WithWriter(newWriter WriterFactory) Option {
+	return func(run *runner) {
+		run.newWriter = newWriter
+	}
+}
+
+// WithOutputs set outputs of the run (OutputRooms, OutputHotelsCounts), all outputs are saved by default.
+// Scans are still read completely, rooms are not sorted and saved without OutputRooms.
+func WithOutputs(outputs ...string) Option {
+	return func(run *runner) {
+		run.outputs = make(map[string]bool)
+		for _, output := range outputs {
+			run.outputs[output] = true
+		}
+	}
+}
+
+// WithUploaders set destinations instead of ones from config (no uploaders disable upload)
+func WithUploaders(uploaders ...Uploader) Option {
+	return func(run *runner) {
+		// non-nil slice even without uploaders
+		run.uploaders = append([]Uploader{}, uploaders...)
+	}
+}
+
+// WithDryRun make Run read and process scans without writing files and uploading them.
+// Report has the names of the files which would be created. Injected writer is not used.
+func WithDryRun() Option {
+	return func(run *runner) {
+		run.dryRun = true
+	}
+}
+
+// WithResume make Run continue the failed run of the same scan IDs from its checkpoint
+// (config.CheckpointRows must be set). New run is started if there is no checkpoint.
+func WithResume() Option {
+	return func(run *runner) {
+		run.resume = true
+	}
+}
+
+// WithClock set time source used for the file names and the report
+func WithClock(now func() time.Time) Option {
+	return func(run *runner) {
+		run.now = now
+	}
+}
+
+// ----- Report -----
+
+// Report is the result of the Run
+type Report struct {
+	Start time.Time
+	End   time.Time
+
+	Scans            []ScanReport
+	HotelsCountsFile string
+	HotelsCountsRows uint
+	BundleFile       string // empty if config.Bundle not set
+	ManifestFile     string
+
+	// files are not created in dry run, file names are the ones which would be created
+	DryRun bool
+
+	// files delivered to all destinations
+	UploadedFiles []string
+}
+
+// ScanReport is the result of the single scan export
+type ScanReport struct {
+	ScanID   uint
+	Channel  string
+	Rows     uint
+	Rooms    uint
+	FileName string // empty if the scan has no rooms
+
+	// rows skipped in the lenient mode, saved into the rejects file
+	Rejects     uint
+	RejectsFile string // empty if nothing was rejected
+
+	// exported rooms summary
+	Channels   []string
+	Hotels     uint
+	CIDateFrom string
+	CIDateTo   string
+}
+
+// ----- Run -----
+
+// Run export rooms and hotels counts of the scans into files and upload them to the destinations.
+// Manifest of the files is uploaded after all of them.
+// Temp files are removed on exit (if cfg.RemoveTMPFiles is set) even if export failed.
+// With cfg.CheckpointRows progress of the run is saved into the checkpoint in cfg.TMPFolder,
+// failed or canceled run can be resumed with WithResume option. Checkpoint is removed after success.
+// Rooms and rejects files of the scans are kept after failure, the resumed run continues them.
+// Returned error is *StageError, use ErrorStage to get the failed stage.
+//
+// Run stops as soon as ctx is done: queries and uploads are interrupted, all files of the run
+// are removed (they are partial, unless checkpoints are enabled) and error with StageCanceled stage is returned.
+//
+// Example:
+//
+//	report, err := cadump.Run(ctx, config, []uint{42}, cadump.WithUploaders())
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Println(report.Scans[0].FileName)
+func Run(ctx context.Context, cfg Config, scanIDs []uint, options ...Option) (report Report, err error) {
+	run := &runner{config: cfg, now: time.Now}
+	for _, option := range options {
+		option(run)
+	}
+
+	if run.dryRun {
+		// nothing to remove, sort would spill rooms into TMP_FOLDER
+		cfg.RemoveTMPFiles, cfg.SkipRoomsSort = false, true
+		run.config = cfg
+	}
+	report.DryRun = run.dryRun
+
+	var files []string
+
+	report.Start = run.now()
+	defer func() {
+		report.End = run.now()
+
+		if ctx.Err() != nil && err != nil {
+			err = &StageError{Stage: StageCanceled, Err: ctx.Err()}
+			if !cfg.RemoveTMPFiles && !run.dryRun && run.checkpoints == nil {
+				for _, file := range files {
+					removeFile(file)
+				}
+			}
+		}
+
+		if run.checkpoints != nil {
+			if err == nil {
+				run.checkpoints.remove()
+			} else {
+				LogWith(Fields{"file": run.checkpoints.path}).Infof("Export progress is saved, the run can be resumed")
+			}
+		}
+	}()
+
+	if run.outputs == nil {
+		run.outputs = map[string]bool{OutputRooms: true, OutputHotelsCounts: true}
+	}
+
+	if run.uploaders == nil {
+		uploaders, err := NewUploaders(cfg)
+		if err != nil {
+			return report, stageError(StageConfig, err)
+		}
+		defer CloseUploaders(uploaders)
+		run.uploaders = uploaders
+	}
+
+	if run.reader == nil {
+		db := NewCassandraReader(cfg.Cassandra)
+		defer db.Close()
+		run.reader = db
+	}
+
+	if run.resume && cfg.CheckpointRows <= 0 {
+		return report, stageError(StageConfig, fmt.Errorf("resume requires CHECKPOINT_ROWS"))
+	}
+	if cfg.CheckpointRows > 0 && !run.dryRun && !run.outputs[OutputRooms] {
+		// hotels counts of the resumed scans are restored from the rooms files
+		log.Warningf("Checkpoints are disabled without rooms output")
+	} else if cfg.CheckpointRows > 0 && !run.dryRun {
+		if _, ok := run.reader.(ResumableReader); !ok {
+			return report, stageError(StageConfig, fmt.Errorf("scan reader doesn't support checkpoints"))
+		}
+		if run.newWriter != nil {
+			return report, stageError(StageConfig, fmt.Errorf("files of the injected writer can't be continued"))
+		}
+		if err := cfg.checkCheckpoints(); err != nil {
+			return report, stageError(StageConfig, err)
+		}
+
+		configHash, err := checkpointConfigHash(cfg, run.outputs)
+		if err != nil {
+			return report, stageError(StageConfig, err)
+		}
+		checkpoints, resumed, err := newCheckpointer(
+			cfg.TMPFolder, scanIDs, uint(cfg.CheckpointRows), run.resume, report.Start, configHash)
+		if err != nil {
+			return report, stageError(StageConfig, err)
+		}
+		run.checkpoints = checkpoints
+		if resumed {
+			report.Start = checkpoints.cp.Start
+			LogWith(Fields{"file": checkpoints.path}).Infof("Resuming export started at %s",
+				report.Start.Format(time.RFC3339))
+		}
+	}
+
+	run.timestamp = report.Start.Format(timestampFormat)
+	run.aggregator = NewAggregator(cfg.Channels...)
+
+	run.filter, err = NewRoomFilter(cfg.Filter, report.Start)
+	if err != nil {
+		return report, stageError(StageConfig, err)
+	}
+
+	run.compression = cfg.FileCompression()
+	if cfg.Bundle {
+		// bundle archive compress all files
+		run.compression = CompressionNone
+	}
+
+	if run.newWriter == nil || run.dryRun {
+		for _, format := range []string{cfg.Output.Rooms, cfg.Output.HotelsCounts} {
+			if err := checkFormat(format); err != nil {
+				return report, stageError(StageConfig, err)
+			}
+		}
+		if err := checkCompression(cfg.FileCompression()); err != nil {
+			return report, stageError(StageConfig, err)
+		}
+
+		output, dryRun, compression := cfg.Output, run.dryRun, run.compression
+		run.newWriter = func(name string, basePath string) (Writer, error) {
+			if dryRun {
+				fileName, err := OutputFileName(output.Format(name), basePath, compression)
+				return &dryRunWriter{fileName: fileName}, err
+			}
+			return NewWriter(output.Format(name), basePath, compression)
+		}
+	}
+
+	log.Infof("Start Scan Data processing for Scan IDs [%s] (workers: %d)\n",
+		scanIDsStr(scanIDs, ", "), cfg.Workers)
+
+	results := run.exportScans(ctx, scanIDs)
+	for i := range results {
+		report.Scans = append(report.Scans, results[i].scan)
+		for _, file := range []string{results[i].scan.FileName, results[i].scan.RejectsFile} {
+			if file == "" {
+				continue
+			}
+			files = append(files, file)
+			if cfg.RemoveTMPFiles {
+				defer func(file string) {
+					// scan files of the failed run are continued by the resumed run
+					if err == nil || run.checkpoints == nil {
+						removeFile(file)
+					}
+				}(file)
+			}
+		}
+	}
+
+	for i := range results {
+		if results[i].err != nil {
+			return report, results[i].err
+		}
+	}
+
+	if err = checkRejects(cfg, report.Scans); err != nil {
+		return report, stageError(StageParse, err)
+	}
+
+	if run.outputs[OutputHotelsCounts] {
+		log.Infof("Saving hotels counters to file")
+
+		report.HotelsCountsFile, report.HotelsCountsRows, err = run.saveHotelsCounts(ctx, scanIDs)
+		if report.HotelsCountsFile != "" {
+			files = append(files, report.HotelsCountsFile)
+			if cfg.RemoveTMPFiles {
+				defer removeFile(report.HotelsCountsFile)
+			}
+		}
+		if err != nil {
+			return report, stageError(StageWrite, fmt.Errorf("save hotels counters error: %s", err))
+		}
+		LogWith(Fields{"file": report.HotelsCountsFile}).Infof("Hotels counts saved")
+	}
+
+	if run.dryRun {
+		if cfg.Bundle {
+			report.BundleFile = run.bundlePath(scanIDs)
+		}
+		report.ManifestFile = run.manifestPath()
+		return report, nil
+	}
+
+	manifest, err := run.manifest(scanIDs, report, files)
+	if err != nil {
+		return report, stageError(StageWrite, err)
+	}
+
+	uploads := append([]string{}, files...)
+	if cfg.Bundle {
+		report.BundleFile, err = run.bundleFiles(ctx, scanIDs, manifest, files)
+		if err != nil {
+			return report, stageError(StageWrite, err)
+		}
+		files = append(files, report.BundleFile)
+		if cfg.RemoveTMPFiles {
+			defer removeFile(report.BundleFile)
+		}
+		LogWith(Fields{"file": report.BundleFile}).Infof("Files bundled")
+		uploads = []string{report.BundleFile}
+
+		bundle, err := NewManifestFile(report.BundleFile)
+		if err != nil {
+			return report, stageError(StageWrite, fmt.Errorf("bundle manifest error: %s", err))
+		}
+		for i := range manifest.Files {
+			manifest.Files[i].Bundle = bundle.Name
+		}
+		manifest.Files = append(manifest.Files, bundle)
+	}
+
+	report.ManifestFile = run.manifestPath()
+	if err = SaveManifest(report.ManifestFile, manifest); err != nil {
+		return report, stageError(StageWrite, err)
+	}
+	files = append(files, report.ManifestFile)
+	if cfg.RemoveTMPFiles {
+		defer removeFile(report.ManifestFile)
+	}
+
+	uploadStart := time.Now()
+	// failed uploads are observed too, they usually take the longest
+	defer func() {
+		metrics.observeStage(metricsStageUpload, time.Since(uploadStart))
+	}()
+	if err = UploadFiles(ctx, uploads, run.uploaders); err != nil {
+		return report, stageError(StageUpload, err)
+	}
+	// manifest is delivered last: its arrival means all files of the run are delivered
+	if err = UploadFiles(ctx, []string{report.ManifestFile}, run.uploaders); err != nil {
+		return report, stageError(StageUpload, err)
+	}
+	report.UploadedFiles = append(uploads, report.ManifestFile)
+
+	return report, nil
+}
+
+// ----- Runner -----
+
+// runner keeps dependencies and shared state of the single Run
+type runner struct {
+	config    Config
+	reader    ScanReader
+	lister    ScanLister // used only by Watch
+	newWriter WriterFactory
+	uploaders []Uploader
+	now       func() time.Time
+	outputs   map[string]bool
+	dryRun    bool
+	resume    bool
+
+	timestamp   string
+	compression string
+	aggregator  *Aggregator
+	filter      *RoomFilter
+	checkpoints *checkpointer // nil if checkpoints are disabled
+}
+
+// scanResult is the result of the single scan export
+type scanResult struct {
+	scan ScanReport
+	err  error
+}
+
+// exportScans export rooms of all scans using the pool of config.Workers goroutines.
+// Results are returned in the same order as scanIDs.
+func (run *runner) exportScans(ctx context.Context, scanIDs []uint) []scanResult {
+	var wg sync.WaitGroup
+	results := make([]scanResult, len(scanIDs))
+	jobs := make(chan int)
+
+	workers := run.config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i].scan.ScanID = scanIDs[i]
+				if results[i].err = ctx.Err(); results[i].err != nil {
+					continue
+				}
+				results[i].err = run.exportScanRooms(ctx, &results[i].scan)
+			}
+		}()
+	}
+
+	for i := range scanIDs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// exportScanRooms stream rooms of the scan into the file and fill the scan report.
+// Rooms pass through the external sort unless config.SkipRoomsSort is set.
+func (run *runner) exportScanRooms(ctx context.Context, scan *ScanReport) error {
+	var err error
+	roomsFile := &scanRoomsFile{
+		scanID:    scan.ScanID,
+		folder:    run.config.TMPFolder,
+		timestamp: run.timestamp,
+		newWriter: run.newWriter}
+	for _, col := range run.config.ExtraColumns {
+		roomsFile.extra = append(roomsFile.extra, col.Name)
+	}
+
+	var writeTime time.Duration
+	write := timedSave(roomsFile.Write, &writeTime)
+
+	if !run.outputs[OutputRooms] {
+		err = run.processScanData(ctx, scan, func([]Room) error { return nil }, nil)
+	} else if run.config.SkipRoomsSort {
+		err = run.processScanData(ctx, scan, write, roomsFile)
+	} else {
+		err = run.processSortedScanData(ctx, scan, write)
+	}
+
+	closeStart := time.Now()
+	fileName, cerr := roomsFile.Close()
+	scan.FileName, scan.Channel = fileName, roomsFile.channel
+
+	if run.outputs[OutputRooms] {
+		metrics.observeStage(metricsStageWrite, writeTime+time.Since(closeStart))
+	}
+	if !run.dryRun {
+		metrics.addFileSize(scan.ScanID, scan.Channel, fileName)
+	}
+	if err == nil {
+		err = stageError(StageWrite, cerr)
+	}
+	if err != nil && fileName != "" && !run.dryRun && run.checkpoints == nil {
+		// partial file is useless, with checkpoints it is kept for resume
+		removeFile(fileName)
+		scan.FileName = ""
+	}
+	return err
+}
+
+// processSortedScanData collect rooms of the scan in the external sorter and save them in sorted order
+func (run *runner) processSortedScanData(ctx context.Context, scan *ScanReport, save func([]Room) error) error {
+	sorter := NewRoomSorter(run.config.TMPFolder, run.config.SortChunkSize)
+	defer func() {
+		if err := sorter.Close(); err != nil {
+			LogWith(Fields{"scan_id": scan.ScanID}).Warningf("Cleanup rooms sort error: %s", err)
+		}
+	}()
+
+	// sort time is rooms spill and merge time without rooms save
+	var sortTime, saveTime time.Duration
+	err := run.processScanData(ctx, scan, timedSave(sorter.Add, &sortTime), nil)
+	if err != nil {
+		return err
+	}
+
+	LogWith(Fields{"scan_id": scan.ScanID}).Infof("Sorting rooms")
+	mergeStart := time.Now()
+	err = sorter.Merge(timedSave(func(rooms []Room) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return save(rooms)
+	}, &saveTime))
+	metrics.observeStage(metricsStageSort, sortTime+time.Since(mergeStart)-saveTime)
+	if err != nil {
+		return stageError(StageWrite, fmt.Errorf("[ScanID: %d] sort rooms error: %s", scan.ScanID, err))
+	}
+	return nil
+}
+
+// processScanData read scan rows from DB, extract rooms and pass them to the aggregator and save function.
+// Rooms not matching the filter are skipped. In the lenient mode rows which can't be parsed are
+// saved into the rejects file instead of failing the scan. Reading stops when ctx is done.
+// With checkpoints roomsFile is the file of the save function, it is continued by the resumed scan.
+func (run *runner) processScanData(ctx context.Context, scan *ScanReport, save func([]Room) error,
+	roomsFile *scanRoomsFile) (err error) {
+
+	scanID := scan.ScanID
+	out := &scanOutput{
+		run:     run,
+		scan:    scan,
+		save:    save,
+		rejects: newRejectsFile(run.config.TMPFolder, scanID, run.compression, run.dryRun),
+		summary: newScanSummary()}
+
+	defer func() {
+		out.summary.fill(scan)
+
+		fileName, cerr := out.rejects.Close()
+		scan.Rejects, scan.RejectsFile = out.rejects.rows, fileName
+		if !run.dryRun {
+			metrics.addFileSize(scanID, "", fileName)
+		}
+		if cerr != nil && err == nil {
+			err = stageError(StageWrite, fmt.Errorf("[ScanID: %d] %s", scanID, cerr))
+		}
+	}()
+
+	if run.checkpoints != nil {
+		err = run.readCheckpointedScanData(ctx, scan, out, roomsFile)
+	} else {
+		err = run.readScanData(ctx, scan, out, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	LogWith(Fields{"scan_id": scanID}).Infof("Processed %d rows. Extracted %d rooms. Rejected %d rows",
+		scan.Rows, scan.Rooms, out.rejects.rows)
+	return nil
+}
+
+// readCheckpointedScanData read rows of the scan saving checkpoints. Resumed scan continues the rooms
+// and rejects files from the checkpoint offsets and the query from the checkpoint position,
+// rooms written before the checkpoint are read back from the rooms file into the hotels counts.
+func (run *runner) readCheckpointedScanData(ctx context.Context, scan *ScanReport, out *scanOutput,
+	roomsFile *scanRoomsFile) error {
+
+	scanLog := LogWith(Fields{"scan_id": scan.ScanID})
+	progress := &scanProgress{checkpoint: run.checkpoints.scan(scan.ScanID), rooms: roomsFile, rejects: out.rejects}
+	cp := &progress.checkpoint
+	scan.Rows = cp.Rows
+
+	if err := run.resumeScanFiles(cp, out, roomsFile); err != nil {
+		return stageError(StageWrite, fmt.Errorf("[ScanID: %d] resume error: %s", scan.ScanID, err))
+	}
+	if cp.Done {
+		scanLog.Infof("Scan was read before, %d rows are taken from the checkpoint", cp.Rows)
+		return nil
+	}
+	if cp.Rows > 0 {
+		scanLog.Infof("Resuming scan from the checkpoint after %d rows", cp.Rows)
+	}
+
+	if err := run.readScanData(ctx, scan, out, progress); err != nil {
+		return err
+	}
+	cp.Done = true
+	return run.saveCheckpoint(progress, scan.Rows)
+}
+
+// resumeScanFiles continue the rooms and rejects files of the checkpoint, rooms written before
+// the checkpoint are counted in the hotels counts and the scan report
+func (run *runner) resumeScanFiles(cp *scanCheckpoint, out *scanOutput, roomsFile *scanRoomsFile) error {
+	if cp.RoomsFile != "" {
+		format := run.config.Output.Rooms
+		if err := readRooms(format, cp.RoomsFile, cp.RoomsOffset, out.countRooms); err != nil {
+			return err
+		}
+		writer, err := appendWriter(format, cp.RoomsFile, cp.RoomsOffset)
+		if err != nil {
+			return err
+		}
+		roomsFile.resume(cp.Channel, writer)
+	}
+	return out.rejects.resume(cp.Rejects, cp.RejectsOffset)
+}
+
+// scanProgress is the checkpoint of the scan being read and the files of the read rows
+type scanProgress struct {
+	checkpoint scanCheckpoint
+	rooms      *scanRoomsFile
+	rejects    *rejectsFile
+	iter       ResumableIter
+}
+
+// saveCheckpoint flush the files and save their offsets and position of the query after the rows
+func (run *runner) saveCheckpoint(progress *scanProgress, rows uint) error {
+	cp := &progress.checkpoint
+	var err error
+	cp.RoomsFile, cp.RoomsOffset, err = progress.rooms.offset()
+	if err == nil {
+		cp.RejectsOffset, err = progress.rejects.offset()
+	}
+	if err != nil {
+		return stageError(StageWrite, fmt.Errorf("[ScanID: %d] %s", cp.ScanID, err))
+	}
+
+	cp.Rows, cp.Channel = rows, progress.rooms.channel
+	cp.Rejects = progress.rejects.rows
+	if cp.Rejects > 0 {
+		cp.RejectsFile, _ = compressedFileName(progress.rejects.basePath, progress.rejects.compression)
+	}
+	if progress.iter != nil {
+		cp.Position = progress.iter.Position()
+	}
+	if err := run.checkpoints.save(*cp); err != nil {
+		return stageError(StageWrite, fmt.Errorf("[ScanID: %d] %s", cp.ScanID, err))
+	}
+	return nil
+}
+
+// readScanData read scan rows from DB, extract rooms and pass them and rejected rows to the output.
+// With progress the query starts from the checkpoint position and the checkpoint is saved
+// every config.CheckpointRows rows. Reading stops when ctx is done.
+func (run *runner) readScanData(ctx context.Context, scan *ScanReport, out *scanOutput,
+	progress *scanProgress) (err error) {
+
+	var tableRow ScanDataTable
+	var iter ScanIter
+	scanID := scan.ScanID
+
+	if progress != nil {
+		// reader is checked by Run
+		progress.iter, err = run.reader.(ResumableReader).SelectScanDataFrom(
+			ctx, scanID, run.filter, progress.checkpoint.Position, &tableRow)
+		if err == nil {
+			iter = progress.iter
+		}
+	} else if reader, ok := run.reader.(FilterReader); ok && run.filter != nil {
+		iter, err = reader.SelectFilteredScanData(ctx, scanID, run.filter, &tableRow)
+	} else {
+		iter, err = run.reader.SelectScanData(ctx, scanID, &tableRow)
+	}
+	queryStart := time.Now()
+	if err != nil {
+		// connection error already has the stage
+		return stageError(StageQuery, err)
+	}
+
+	timedIter := &timedScanIter{ScanIter: iter}
+	var extractTime time.Duration
+	defer func() {
+		metrics.observeStage(metricsStageQuery, time.Since(queryStart)-timedIter.busy)
+		metrics.observeStage(metricsStageExtract, extractTime)
+	}()
+
+	defer func(i ScanIter) {
+		if cerr := i.Close(); cerr != nil && err == nil {
+			err = stageError(StageQuery, fmt.Errorf("[ScanID: %d] read scan_data error: %s", scanID, cerr))
+		}
+	}(iter)
+
+	scanLog := LogWith(Fields{"scan_id": scanID})
+
+	for timedIter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		scan.Rows++
+		if scan.Rows%100 == 0 {
+			scanLog.Infof("Processed %d rows", scan.Rows)
+		}
+		channel := strings.Title(tableRow.AuxDataProvider)
+		metrics.rowsRead.WithLabelValues(scanLabel(scanID), channel).Inc()
+
+		extractStart := time.Now()
+		rooms, err := ExtractRooms(tableRow, run.config.Cassandra.Schema, run.config.ExtraColumns...)
+		extractTime += time.Since(extractStart)
+
+		if err := run.handleRow(scan, channel, rooms, err, out); err != nil {
+			return err
+		}
+
+		if progress != nil && run.checkpoints.due(scan.Rows) {
+			if err := run.saveCheckpoint(progress, scan.Rows); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleRow pass filtered rooms of the row or the row reject (in the lenient mode) to the output.
+// Metrics are counted here when the row is read, so rooms restored on resume are not counted twice.
+func (run *runner) handleRow(scan *ScanReport, channel string, rooms []Room, err error, out *scanOutput) error {
+	var rowErr *RowError
+	if err != nil && run.config.Lenient && errors.As(err, &rowErr) {
+		LogWith(Fields{"scan_id": scan.ScanID, "stage": StageParse}).Warningf("Row rejected: %s", err)
+		metrics.rowsRejected.WithLabelValues(scanLabel(scan.ScanID), channel).Inc()
+		reject := Reject{AuxDataFuid: rowErr.Fuid.String(), Field: rowErr.Field, Error: rowErr.Err.Error()}
+		return out.addReject(reject)
+	}
+	if err != nil {
+		return stageError(StageParse, fmt.Errorf("[ScanID: %d] parse rooms error: %s", scan.ScanID, err))
+	}
+
+	// extracted rooms are counted before the filter, filtered rooms are the output rooms of the report
+	metrics.roomsExtracted.WithLabelValues(scanLabel(scan.ScanID), channel).Add(float64(len(rooms)))
+	rooms = run.filter.Filter(rooms)
+	if len(rooms) == 0 {
+		return nil
+	}
+	if len(rooms) == 1 && rooms[0].Rate == "" {
+		// skip unavailable hotels
+		return nil
+	}
+	return out.addRooms(rooms)
+}
+
+// scanOutput pass rooms of the scan to the aggregator and save function, rejects to the rejects file
+type scanOutput struct {
+	run     *runner
+	scan    *ScanReport
+	save    func([]Room) error
+	rejects *rejectsFile
+	summary *scanSummary
+}
+
+func (out *scanOutput) addRooms(rooms []Room) error {
+	if err := out.save(rooms); err != nil {
+		return stageError(StageWrite, fmt.Errorf("[ScanID: %d] %s", out.scan.ScanID, err))
+	}
+	out.countRooms(rooms)
+	return nil
+}
+
+// countRooms add saved rooms to the hotels counts and the scan report
+func (out *scanOutput) countRooms(rooms []Room) {
+	out.run.aggregator.AddRooms(rooms)
+	out.scan.Rooms += uint(len(rooms))
+	out.summary.add(rooms)
+}
+
+func (out *scanOutput) addReject(reject Reject) error {
+	if err := out.rejects.Add(reject); err != nil {
+		return stageError(StageWrite, fmt.Errorf("[ScanID: %d] %s", out.scan.ScanID, err))
+	}
+	return nil
+}
+
+// timedScanIter measure time between Next calls spent by the caller, the rest is query time
+type timedScanIter struct {
+	ScanIter
+	busy     time.Duration
+	returned time.Time
+}
+
+func (iter *timedScanIter) Next() bool {
+	if !iter.returned.IsZero() {
+		iter.busy += time.Since(iter.returned)
+	}
+	next := iter.ScanIter.Next()
+	iter.returned = time.Now()
+	return next
+}
+
+// timedSave return save function adding its duration to the total
+func timedSave(save func([]Room) error, total *time.Duration) func([]Room) error {
+	return func(rooms []Room) error {
+		start := time.Now()
+		err := save(rooms)
+		*total += time.Since(start)
+		return err
+	}
+}
+
+// scanSummary collect channels, hotels and check-in dates range of the scan rooms
+type scanSummary struct {
+	channels map[string]bool
+	hotels   map[string]bool
+
+	ciDateFrom, ciDateTo string
+}
+
+func newScanSummary() *scanSummary {
+	return &scanSummary{channels: make(map[string]bool), hotels: make(map[string]bool)}
+}
+
+func (summary *scanSummary) add(rooms []Room) {
+	for _, room := range rooms {
+		summary.channels[room.Channel] = true
+		summary.hotels[room.HotelCode+"|"+room.HotelName] = true
+
+		if summary.ciDateFrom == "" || cmpDate(room.CIDate) < cmpDate(summary.ciDateFrom) {
+			summary.ciDateFrom = room.CIDate
+		}
+		if cmpDate(room.CIDate) > cmpDate(summary.ciDateTo) {
+			summary.ciDateTo = room.CIDate
+		}
+	}
+}
+
+// fill set summary fields of the scan report
+func (summary *scanSummary) fill(scan *ScanReport) {
+	scan.Channels = nil
+	for channel := range summary.channels {
+		scan.Channels = append(scan.Channels, channel)
+	}
+	sort.Strings(scan.Channels)
+
+	scan.Hotels = uint(len(summary.hotels))
+	scan.CIDateFrom, scan.CIDateTo = summary.ciDateFrom, summary.ciDateTo
+}
+
+// checkRejects return error if rejected rows of all scans exceed config.MaxRejectsPercent of the rows
+func checkRejects(cfg Config, scans []ScanReport) error {
+	var rows, rejects uint
+	for _, scan := range scans {
+		rows, rejects = rows+scan.Rows, rejects+scan.Rejects
+	}
+	if rejects == 0 {
+		return nil
+	}
+
+	percent := float64(rejects) * 100 / float64(rows)
+	LogWith(Fields{"stage": StageParse}).Warningf("Rejected %d of %d rows (%.2f%%)", rejects, rows, percent)
+
+	if cfg.MaxRejectsPercent > 0 && percent > cfg.MaxRejectsPercent {
+		return fmt.Errorf("rejected %d of %d rows (%.2f%%), more than MAX_REJECTS_PERCENT %g%%",
+			rejects, rows, percent, cfg.MaxRejectsPercent)
+	}
+	return nil
+}
+
+// saveHotelsCounts save aggregated hotels counts and return the file name and the number of rows
+func (run *runner) saveHotelsCounts(ctx context.Context, scanIDs []uint) (fileName string, rows uint, err error) {
+	basePath := filepath.Join(run.config.TMPFolder,
+		fmt.Sprintf("hotels_counts-%s-%s", run.timestamp, scanIDsStr(scanIDs, "_")))
+
+	if err = ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	writer, err := run.newWriter(OutputHotelsCounts, basePath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	table := run.aggregator.HotelsCountsTable()
+	err = writer.Write(table)
+	if cerr := writer.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return writer.FileName(), uint(len(table.Rows)), err
+}
+
+// manifest describe files of the run: checksums, rows, scans and channels
+func (run *runner) manifest(scanIDs []uint, report Report, files []string) (Manifest, error) {
+	manifest := Manifest{
+		Version: Version,
+		Start:   report.Start,
+		End:     run.now(),
+		ScanIDs: scanIDs}
+
+	for _, file := range files {
+		entry, err := NewManifestFile(file)
+		if err != nil {
+			return manifest, fmt.Errorf("manifest error: %s", err)
+		}
+
+		if file == report.HotelsCountsFile {
+			entry.Rows = report.HotelsCountsRows
+		}
+		for _, scan := range report.Scans {
+			if scan.FileName == file {
+				entry.Rows, entry.ScanID, entry.Channel = scan.Rooms, scan.ScanID, scan.Channel
+			}
+			if scan.RejectsFile == file {
+				entry.Rows, entry.ScanID = scan.Rejects, scan.ScanID
+			}
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+	return manifest, nil
+}
+
+// bundleFiles pack files of the run with the manifest into single archive and return its name
+func (run *runner) bundleFiles(ctx context.Context, scanIDs []uint, manifest Manifest, files []string) (string, error) {
+	bundlePath := run.bundlePath(scanIDs)
+	return bundlePath, BundleFiles(ctx, bundlePath, files, manifest)
+}
+
+// bundlePath return path of the bundle archive
+func (run *runner) bundlePath(scanIDs []uint) string {
+	return filepath.Join(run.config.TMPFolder,
+		fmt.Sprintf("cadump-%s-%s.zip", run.timestamp, scanIDsStr(scanIDs, "_")))
+}
+
+// manifestPath return path of the run manifest
+func (run *runner) manifestPath() string {
+	return filepath.Join(run.config.TMPFolder, fmt.Sprintf("manifest-%s.json", run.timestamp))
+}
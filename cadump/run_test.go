@@ -0,0 +1,582 @@
+package cadump_test
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cadump/cadump"
+)
+
+// ----- Test vars ---
+
+// testReader return prepared rows of the scans
+type testReader struct {
+	scans  map[uint][]cadump.ScanDataTable
+	err    error
+	onNext func()
+}
+
+func (reader *testReader) SelectScanData(
+	ctx context.Context, scanID uint, dest *cadump.ScanDataTable) (cadump.ScanIter, error) {
+
+	return &testIter{rows: reader.scans[scanID], dest: dest, err: reader.err, onNext: reader.onNext}, nil
+}
+
+func (reader *testReader) Close() {}
+
+type testIter struct {
+	rows   []cadump.ScanDataTable
+	dest   *cadump.ScanDataTable
+	err    error
+	onNext func()
+}
+
+func (iter *testIter) Next() bool {
+	if iter.onNext != nil {
+		iter.onNext()
+	}
+	if iter.err != nil || len(iter.rows) == 0 {
+		return false
+	}
+	*iter.dest, iter.rows = iter.rows[0], iter.rows[1:]
+	return true
+}
+
+func (iter *testIter) Close() error {
+	return iter.err
+}
+
+// testResumableReader return prepared rows starting from the position (PageRows is the row index),
+// reading fails at the failAt row if it is set
+type testResumableReader struct {
+	testReader
+	failAt int
+	from   []cadump.ScanPosition
+}
+
+func (reader *testResumableReader) SelectScanDataFrom(ctx context.Context, scanID uint, filter *cadump.RoomFilter,
+	pos cadump.ScanPosition, dest *cadump.ScanDataTable) (cadump.ResumableIter, error) {
+
+	reader.from = append(reader.from, pos)
+	rows := reader.scans[scanID][pos.PageRows:]
+	return &testResumableIter{testIter: testIter{rows: rows, dest: dest}, pos: pos, failAt: reader.failAt}, nil
+}
+
+type testResumableIter struct {
+	testIter
+	pos    cadump.ScanPosition
+	failAt int
+}
+
+func (iter *testResumableIter) Next() bool {
+	if iter.failAt > 0 && iter.pos.PageRows == iter.failAt {
+		iter.err = fmt.Errorf("read timeout")
+	}
+	if !iter.testIter.Next() {
+		return false
+	}
+	iter.pos.PageRows++
+	return true
+}
+
+func (iter *testResumableIter) Position() cadump.ScanPosition {
+	return iter.pos
+}
+
+// testUploader keep content of the uploaded files
+type testUploader struct {
+	files map[string]string
+}
+
+func (up *testUploader) Upload(ctx context.Context, filePath string) error {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	up.files[filepath.Base(filePath)] = string(data)
+	return nil
+}
+
+func (up *testUploader) String() string { return "test" }
+func (up *testUploader) Close() error   { return nil }
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func testClock() time.Time {
+	return time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+}
+
+// ----- Tests -----
+
+func TestRun(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow()}, 43: {}}}
+	uploader := &testUploader{files: make(map[string]string)}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true, Workers: 2}
+
+	report, err := cadump.Run(context.Background(), config, []uint{42, 43},
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+
+	roomsFile := filepath.Join(tmpFolder, "rooms-2020_05_01-10_00_00-Marriott-42.csv")
+	countsFile := filepath.Join(tmpFolder, "hotels_counts-2020_05_01-10_00_00-42_43.csv")
+	manifestFile := filepath.Join(tmpFolder, "manifest-2020_05_01-10_00_00.json")
+
+	equals(t, []cadump.ScanReport{
+		{ScanID: 42, Channel: "Marriott", Rows: 1, Rooms: 3, FileName: roomsFile, Channels: []string{"Marriott"},
+			Hotels: 1, CIDateFrom: "18/01/2019", CIDateTo: "18/01/2019"},
+		{ScanID: 43}}, report.Scans)
+	equals(t, countsFile, report.HotelsCountsFile)
+	equals(t, uint(1), report.HotelsCountsRows)
+	equals(t, []string{roomsFile, countsFile, manifestFile}, report.UploadedFiles)
+	equals(t, manifestFile, report.ManifestFile)
+	equals(t, testClock(), report.Start)
+
+	equals(t, 3, len(uploader.files))
+	counts := "Hotel name,Hotel Code,CI date,Marriott,Other\n" +
+		"FPBS Kolasin,TGDFP,18/01/2019,3,0\n"
+	equals(t, counts, uploader.files["hotels_counts-2020_05_01-10_00_00-42_43.csv"])
+
+	var manifest cadump.Manifest
+	ok(t, json.Unmarshal([]byte(uploader.files["manifest-2020_05_01-10_00_00.json"]), &manifest))
+	equals(t, cadump.Version, manifest.Version)
+	equals(t, []uint{42, 43}, manifest.ScanIDs)
+	equals(t, testClock(), manifest.Start)
+	equals(t, 2, len(manifest.Files))
+	equals(t, cadump.ManifestFile{Name: "rooms-2020_05_01-10_00_00-Marriott-42.csv",
+		Size:   int64(len(uploader.files["rooms-2020_05_01-10_00_00-Marriott-42.csv"])),
+		SHA256: sha256Hex(uploader.files["rooms-2020_05_01-10_00_00-Marriott-42.csv"]),
+		Rows:   3, ScanID: 42, Channel: "Marriott"}, manifest.Files[0])
+	equals(t, cadump.ManifestFile{Name: "hotels_counts-2020_05_01-10_00_00-42_43.csv",
+		Size: int64(len(counts)), SHA256: sha256Hex(counts), Rows: 1}, manifest.Files[1])
+
+	// temp files are removed
+	files, err := ioutil.ReadDir(tmpFolder)
+	ok(t, err)
+	equals(t, 0, len(files))
+}
+
+func TestRun_Bundle(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow()}}}
+	uploader := &testUploader{files: make(map[string]string)}
+	config := cadump.Config{TMPFolder: tmpFolder, Bundle: true, Compression: cadump.CompressionGzip}
+
+	report, err := cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+
+	bundleFile := filepath.Join(tmpFolder, "cadump-2020_05_01-10_00_00-42.zip")
+	equals(t, bundleFile, report.BundleFile)
+	equals(t, []string{bundleFile, report.ManifestFile}, report.UploadedFiles)
+	equals(t, 2, len(uploader.files))
+
+	archive, err := zip.OpenReader(bundleFile)
+	ok(t, err)
+	defer archive.Close()
+
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	// bundled files are not compressed
+	equals(t, []string{"rooms-2020_05_01-10_00_00-Marriott-42.csv", "hotels_counts-2020_05_01-10_00_00-42.csv",
+		"manifest.json"}, names)
+
+	entry, err := archive.File[2].Open()
+	ok(t, err)
+	defer entry.Close()
+
+	var manifest cadump.Manifest
+	ok(t, json.NewDecoder(entry).Decode(&manifest))
+	equals(t, []uint{42}, manifest.ScanIDs)
+	equals(t, 2, len(manifest.Files))
+	equals(t, int64(archive.File[0].UncompressedSize64), manifest.Files[0].Size)
+	equals(t, uint(3), manifest.Files[0].Rows)
+	equals(t, "hotels_counts-2020_05_01-10_00_00-42.csv", manifest.Files[1].Name)
+
+	// delivered manifest list the bundle and its content
+	ok(t, json.Unmarshal([]byte(uploader.files["manifest-2020_05_01-10_00_00.json"]), &manifest))
+	equals(t, 3, len(manifest.Files))
+	equals(t, "cadump-2020_05_01-10_00_00-42.zip", manifest.Files[0].Bundle)
+	equals(t, cadump.ManifestFile{Name: "cadump-2020_05_01-10_00_00-42.zip",
+		Size:   int64(len(uploader.files["cadump-2020_05_01-10_00_00-42.zip"])),
+		SHA256: sha256Hex(uploader.files["cadump-2020_05_01-10_00_00-42.zip"])}, manifest.Files[2])
+}
+
+func TestRun_Outputs(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow()}}}
+	config := cadump.Config{TMPFolder: tmpFolder}
+
+	report, err := cadump.Run(context.Background(), config, []uint{42}, cadump.WithOutputs(cadump.OutputRooms),
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	ok(t, err)
+	equals(t, filepath.Join(tmpFolder, "rooms-2020_05_01-10_00_00-Marriott-42.csv"), report.Scans[0].FileName)
+	equals(t, "", report.HotelsCountsFile)
+
+	report, err = cadump.Run(context.Background(), config, []uint{42}, cadump.WithOutputs(cadump.OutputHotelsCounts),
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	ok(t, err)
+	equals(t, cadump.ScanReport{ScanID: 42, Rows: 1, Rooms: 3, Channels: []string{"Marriott"},
+		Hotels: 1, CIDateFrom: "18/01/2019", CIDateTo: "18/01/2019"}, report.Scans[0])
+	equals(t, filepath.Join(tmpFolder, "hotels_counts-2020_05_01-10_00_00-42.csv"), report.HotelsCountsFile)
+	equals(t, uint(1), report.HotelsCountsRows)
+}
+
+func TestRun_ExtraColumns(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	row := scanDataRow()
+	row.ExtData["meal_plan"] = json2str(map[string]string{"1": "RO", "2": "BB", "3": "HB"})
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {row}}}
+	uploader := &testUploader{files: make(map[string]string)}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true, ExtraColumns: []cadump.ExtraColumnConfig{
+		{Name: "Meal plan", ExtData: "meal_plan"}, {Name: "Currency code", Field: "currency"}}}
+
+	_, err = cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+
+	lines := strings.Split(uploader.files["rooms-2020_05_01-10_00_00-Marriott-42.csv"], "\n")
+	equals(t, "Hotel name,Hotel Code,CI date,LOS,Channel,Room name,Product #,Rate,Currency,Description,"+
+		"Tab name,Snapshot,Meal plan,Currency code", lines[0])
+	equals(t, "FPBS Kolasin,TGDFP,18/01/2019,2,Marriott,Standard Room,1,100,EUR,No breakfast,"+
+		"Standard Rates,https://s3.amazonaws.com/img/fpbs_test.png,RO,eur", lines[1])
+}
+
+func TestRun_DryRun(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow()}}}
+	uploader := &testUploader{files: make(map[string]string)}
+	config := cadump.Config{TMPFolder: tmpFolder, Compression: cadump.CompressionGzip, Bundle: true,
+		Output: cadump.OutputConfig{HotelsCounts: cadump.FormatXLSX}}
+
+	report, err := cadump.Run(context.Background(), config, []uint{42}, cadump.WithDryRun(),
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+
+	equals(t, true, report.DryRun)
+	equals(t, cadump.ScanReport{ScanID: 42, Channel: "Marriott", Rows: 1, Rooms: 3,
+		FileName: filepath.Join(tmpFolder, "rooms-2020_05_01-10_00_00-Marriott-42.csv"), Channels: []string{"Marriott"},
+		Hotels: 1, CIDateFrom: "18/01/2019", CIDateTo: "18/01/2019"}, report.Scans[0])
+	equals(t, filepath.Join(tmpFolder, "hotels_counts-2020_05_01-10_00_00-42.xlsx"), report.HotelsCountsFile)
+	equals(t, uint(1), report.HotelsCountsRows)
+	equals(t, filepath.Join(tmpFolder, "cadump-2020_05_01-10_00_00-42.zip"), report.BundleFile)
+	equals(t, filepath.Join(tmpFolder, "manifest-2020_05_01-10_00_00.json"), report.ManifestFile)
+	equals(t, 0, len(report.UploadedFiles))
+	equals(t, 0, len(uploader.files))
+
+	// nothing is written
+	files, err := ioutil.ReadDir(tmpFolder)
+	ok(t, err)
+	equals(t, 0, len(files))
+}
+
+func TestRun_Filter(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	other := scanDataRow()
+	other.ExtData["aux_data_customer_hotel_id"] = "OTHER"
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow(), other}}}
+	config := cadump.Config{TMPFolder: tmpFolder, Filter: cadump.FilterConfig{HotelCodes: []string{"TGDFP"}}}
+
+	report, err := cadump.Run(context.Background(), config, []uint{42}, cadump.WithOutputs(cadump.OutputHotelsCounts),
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	ok(t, err)
+	equals(t, cadump.ScanReport{ScanID: 42, Rows: 2, Rooms: 3, Channels: []string{"Marriott"},
+		Hotels: 1, CIDateFrom: "18/01/2019", CIDateTo: "18/01/2019"}, report.Scans[0])
+	equals(t, uint(1), report.HotelsCountsRows)
+
+	config.Filter = cadump.FilterConfig{CIFrom: "wrong"}
+	_, err = cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageConfig, stage)
+}
+
+func TestRun_Lenient(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	broken := scanDataRow()
+	broken.ExtData["room_name"] = "{broken"
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow(), broken}}}
+	uploader := &testUploader{files: make(map[string]string)}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true}
+
+	_, err = cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageParse, stage)
+	equals(t, "parse error: [ScanID: 42] parse rooms error: [00000000-1111-2222-3333-444444444444] "+
+		"field 'ext_data.room_name' parse error: field JSON unmarshalling error: "+
+		"invalid character 'b' looking for beginning of object key string", err.Error())
+
+	config.Lenient = true
+	report, err := cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+
+	rejectsFile := filepath.Join(tmpFolder, "rejects-42.csv")
+	equals(t, uint(2), report.Scans[0].Rows)
+	equals(t, uint(3), report.Scans[0].Rooms)
+	equals(t, uint(1), report.Scans[0].Rejects)
+	equals(t, rejectsFile, report.Scans[0].RejectsFile)
+
+	rejects := "aux_data_fuid,field,error\n" +
+		"00000000-1111-2222-3333-444444444444,ext_data.room_name,field JSON unmarshalling error: " +
+		"invalid character 'b' looking for beginning of object key string\n"
+	equals(t, rejects, uploader.files["rejects-42.csv"])
+
+	var manifest cadump.Manifest
+	ok(t, json.Unmarshal([]byte(uploader.files["manifest-2020_05_01-10_00_00.json"]), &manifest))
+	equals(t, cadump.ManifestFile{Name: "rejects-42.csv", Size: int64(len(rejects)),
+		SHA256: sha256Hex(rejects), Rows: 1, ScanID: 42}, manifest.Files[1])
+
+	// 1 of 2 rows is rejected
+	config.MaxRejectsPercent = 10
+	_, err = cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	stage, _ = cadump.ErrorStage(err)
+	equals(t, cadump.StageParse, stage)
+	equals(t, "parse error: rejected 1 of 2 rows (50.00%), more than MAX_REJECTS_PERCENT 10%", err.Error())
+
+	files, err := ioutil.ReadDir(tmpFolder)
+	ok(t, err)
+	equals(t, 0, len(files))
+}
+
+func TestRun_Resume(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	broken, late := scanDataRow(), scanDataRow()
+	broken.ExtData["room_name"] = "{broken"
+	late.CIDate, late.CODate = str2date("2019-01-10"), str2date("2019-01-11")
+	scans := map[uint][]cadump.ScanDataTable{42: {scanDataRow(), broken, late, scanDataRow()}}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true, Lenient: true, SkipRoomsSort: true,
+		CheckpointRows: 2}
+
+	// uninterrupted run
+	expected := &testUploader{files: make(map[string]string)}
+	_, err = cadump.Run(context.Background(), config, []uint{42}, cadump.WithReader(&testResumableReader{
+		testReader: testReader{scans: scans}}), cadump.WithUploaders(expected), cadump.WithClock(testClock))
+	ok(t, err)
+
+	// run fails after 3 rows and is resumed from the checkpoint after 2 rows,
+	// rooms of the third row written after the checkpoint are removed from the file
+	reader := &testResumableReader{testReader: testReader{scans: scans}, failAt: 3}
+	uploader := &testUploader{files: make(map[string]string)}
+	_, err = cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageQuery, stage)
+	_, err = os.Stat(filepath.Join(tmpFolder, "checkpoint-42.json"))
+	ok(t, err)
+	_, err = os.Stat(filepath.Join(tmpFolder, "rooms-2020_05_01-10_00_00-Marriott-42.csv"))
+	ok(t, err)
+
+	// written rooms depend on the filter, resume with another filter is refused
+	changed := config
+	changed.Filter.Channels = []string{"booking"}
+	_, err = cadump.Run(context.Background(), changed, []uint{42}, cadump.WithResume(),
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	stage, _ = cadump.ErrorStage(err)
+	equals(t, cadump.StageConfig, stage)
+	equals(t, true, strings.Contains(err.Error(), "was saved with different FILTER"))
+
+	reader.failAt = 0
+	later := func() time.Time { return testClock().Add(time.Hour) }
+	report, err := cadump.Run(context.Background(), config, []uint{42}, cadump.WithResume(),
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(later))
+	ok(t, err)
+	equals(t, []cadump.ScanPosition{{}, {PageRows: 2}}, reader.from)
+	equals(t, testClock(), report.Start.UTC())
+	equals(t, uint(4), report.Scans[0].Rows)
+	equals(t, uint(9), report.Scans[0].Rooms)
+	equals(t, uint(1), report.Scans[0].Rejects)
+	equals(t, []string{"Marriott"}, report.Scans[0].Channels)
+
+	// manifest has run end time
+	delete(expected.files, "manifest-2020_05_01-10_00_00.json")
+	delete(uploader.files, "manifest-2020_05_01-10_00_00.json")
+	equals(t, 3, len(uploader.files))
+	equals(t, expected.files, uploader.files)
+
+	files, err := ioutil.ReadDir(tmpFolder)
+	ok(t, err)
+	equals(t, 0, len(files))
+
+	// sorted rooms file can't be continued
+	sorted := config
+	sorted.SkipRoomsSort = false
+	_, err = cadump.Run(context.Background(), sorted, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	stage, _ = cadump.ErrorStage(err)
+	equals(t, cadump.StageConfig, stage)
+	equals(t, "config error: CHECKPOINT_ROWS requires SKIP_ROOMS_SORT: true", err.Error())
+
+	config.CheckpointRows = 0
+	_, err = cadump.Run(context.Background(), config, []uint{42}, cadump.WithResume(),
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	stage, _ = cadump.ErrorStage(err)
+	equals(t, cadump.StageConfig, stage)
+}
+
+func TestRun_ResumeJSONL(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	late := scanDataRow()
+	late.CIDate, late.CODate = str2date("2019-01-10"), str2date("2019-01-11")
+	scans := map[uint][]cadump.ScanDataTable{42: {scanDataRow(), late, scanDataRow()}}
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true, SkipRoomsSort: true, CheckpointRows: 1,
+		Output: cadump.OutputConfig{Rooms: cadump.FormatJSONL}}
+
+	expected := &testUploader{files: make(map[string]string)}
+	_, err = cadump.Run(context.Background(), config, []uint{42}, cadump.WithReader(&testResumableReader{
+		testReader: testReader{scans: scans}}), cadump.WithUploaders(expected), cadump.WithClock(testClock))
+	ok(t, err)
+
+	// hotels counts of the rows before the checkpoint are read back from the JSONL rooms file
+	reader := &testResumableReader{testReader: testReader{scans: scans}, failAt: 2}
+	_, err = cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+	equals(t, true, err != nil)
+
+	reader.failAt = 0
+	uploader := &testUploader{files: make(map[string]string)}
+	report, err := cadump.Run(context.Background(), config, []uint{42}, cadump.WithResume(),
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+	equals(t, uint(9), report.Scans[0].Rooms)
+	equals(t, uint(1), report.Scans[0].Hotels)
+	equals(t, "10/01/2019", report.Scans[0].CIDateFrom)
+	equals(t, "18/01/2019", report.Scans[0].CIDateTo)
+
+	delete(expected.files, "manifest-2020_05_01-10_00_00.json")
+	delete(uploader.files, "manifest-2020_05_01-10_00_00.json")
+	equals(t, expected.files, uploader.files)
+}
+
+func TestRun_QueryError(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{err: fmt.Errorf("read timeout")}
+	config := cadump.Config{TMPFolder: tmpFolder}
+
+	report, err := cadump.Run(context.Background(), config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(), cadump.WithClock(testClock))
+
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageQuery, stage)
+	equals(t, "query error: [ScanID: 42] read scan_data error: read timeout", err.Error())
+	equals(t, []cadump.ScanReport{{ScanID: 42}}, report.Scans)
+	equals(t, 0, len(report.UploadedFiles))
+}
+
+// failingWriter is the file writer failing on the second rows batch
+type failingWriter struct {
+	cadump.Writer
+	writes int
+}
+
+func (writer *failingWriter) Write(rows interface{}) error {
+	if writer.writes++; writer.writes == 2 {
+		return fmt.Errorf("disk full")
+	}
+	return writer.Writer.Write(rows)
+}
+
+func TestRun_WriteError(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow(), scanDataRow()}}}
+	config := cadump.Config{TMPFolder: tmpFolder, SkipRoomsSort: true}
+	newWriter := func(output string, basePath string) (cadump.Writer, error) {
+		writer, err := cadump.NewWriter(cadump.FormatCSV, basePath, cadump.CompressionNone)
+		return &failingWriter{Writer: writer}, err
+	}
+
+	report, err := cadump.Run(context.Background(), config, []uint{42}, cadump.WithReader(reader),
+		cadump.WithWriter(newWriter), cadump.WithUploaders(), cadump.WithClock(testClock))
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageWrite, stage)
+	equals(t, "", report.Scans[0].FileName)
+
+	// partial rooms file is removed
+	files, err := ioutil.ReadDir(tmpFolder)
+	ok(t, err)
+	equals(t, 0, len(files))
+}
+
+func TestRun_Canceled(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-run")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel the run in the middle of the scan
+	rows := 0
+	reader := &testReader{
+		scans: map[uint][]cadump.ScanDataTable{42: {scanDataRow(), scanDataRow(), scanDataRow()}},
+		onNext: func() {
+			if rows++; rows == 2 {
+				cancel()
+			}
+		}}
+	uploader := &testUploader{files: make(map[string]string)}
+	config := cadump.Config{TMPFolder: tmpFolder, SkipRoomsSort: true}
+
+	_, err = cadump.Run(ctx, config, []uint{42},
+		cadump.WithReader(reader), cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageCanceled, stage)
+	equals(t, "canceled error: context canceled", err.Error())
+	equals(t, 0, len(uploader.files))
+
+	// partial rooms file is removed
+	files, err := ioutil.ReadDir(tmpFolder)
+	ok(t, err)
+	equals(t, 0, len(files))
+}
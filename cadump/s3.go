@@ -0,0 +1,190 @@
+package cadump
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3Service       = "s3"
+	s3SignAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// ----- S3 compatible storage -----
+
+// S3Uploader put files to the S3 compatible object storage (AWS S3, MinIO, Ceph, ...).
+// Objects are addressed in path style: "<endpoint>/<bucket>/<prefix>/<file name>",
+// requests are signed with AWS Signature Version 4.
+type S3Uploader struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+
+	client *http.Client
+	now    func() time.Time // time of the request signatures
+}
+
+// NewS3Uploader is S3Uploader constructor
+func NewS3Uploader(dest DestinationConfig) (*S3Uploader, error) {
+	if dest.Endpoint == "" || dest.Bucket == "" {
+		return nil, fmt.Errorf("s3 destination endpoint or bucket not set")
+	}
+
+	endpoint, err := url.Parse(dest.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 destination endpoint parse error: %s", err)
+	}
+
+	region := dest.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	return &S3Uploader{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    dest.Bucket,
+		prefix:    dest.Prefix,
+		accessKey: dest.AccessKey,
+		secretKey: dest.SecretKey,
+		client:    &http.Client{Timeout: httpUploadTimeout},
+		now:       time.Now}, nil
+}
+
+func (up *S3Uploader) String() string {
+	return fmt.Sprintf("s3 %s/%s/%s", up.endpoint, up.bucket, up.prefix)
+}
+
+// Close release idle HTTP connections
+func (up *S3Uploader) Close() error {
+	up.client.CloseIdleConnections()
+	return nil
+}
+
+// Upload put the file as object to the bucket
+func (up *S3Uploader) Upload(ctx context.Context, filePath string) error {
+	payloadHash, size, err := fileSHA256(filePath)
+	if err != nil {
+		return err
+	}
+
+	inFile, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open file '%s' error: %s", filePath, err)
+	}
+	defer inFile.Close()
+
+	objectURL := *up.endpoint
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + up.bucket + "/" +
+		remotePath(up.prefix, filePath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), inFile)
+	if err != nil {
+		return fmt.Errorf("create S3 request error: %s", err)
+	}
+	req.ContentLength = size
+	up.sign(req, payloadHash)
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("Uploading file to %s", objectURL.String())
+	resp, err := up.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("S3 upload error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 upload error: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("File saved to S3")
+	return nil
+}
+
+// sign add AWS Signature Version 4 headers to the request
+func (up *S3Uploader) sign(req *http.Request, payloadHash string) {
+	now := up.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if up.accessKey == "" {
+		// anonymous access
+		return
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, up.region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+up.secretKey), date)
+	for _, part := range []string{up.region, s3Service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, up.accessKey, scope, signedHeaders, signature))
+}
+
+// ----- Helpers -----
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileSHA256 return hex SHA-256 checksum and size of the file
+func fileSHA256(filePath string) (string, int64, error) {
+	inFile, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, fmt.Errorf("open file '%s' error: %s", filePath, err)
+	}
+	defer inFile.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, inFile)
+	if err != nil {
+		return "", 0, fmt.Errorf("read file '%s' error: %s", filePath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
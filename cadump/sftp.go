@@ -0,0 +1,229 @@
+package cadump
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpDefaultPort = 22
+	sftpDialTimeout = 30 * time.Second
+)
+
+// ----- SFTP -----
+
+// SFTPUploader upload files to SFTP server.
+// Authentication is done with password and/or private key file, server host key is checked against
+// known_hosts file (the check can be skipped only explicitly with insecure_ignore_host_key).
+// In atomic rename mode file is uploaded with ".part" suffix and renamed to the final name after upload.
+type SFTPUploader struct {
+	addr         string
+	remoteDir    string
+	atomicRename bool
+	sshConfig    *ssh.ClientConfig
+}
+
+// NewSFTPUploader is SFTPUploader constructor
+func NewSFTPUploader(dest DestinationConfig) (*SFTPUploader, error) {
+	if dest.Host == "" || dest.User == "" {
+		return nil, fmt.Errorf("sftp destination host or user not set")
+	}
+
+	var auth []ssh.AuthMethod
+	if dest.KeyFile != "" {
+		key, err := ioutil.ReadFile(dest.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read sftp key file error: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("parse sftp key file error: %s", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if dest.Password != "" {
+		auth = append(auth, ssh.Password(dest.Password))
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case dest.KnownHosts != "":
+		callback, err := knownhosts.New(dest.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("read sftp known_hosts error: %s", err)
+		}
+		hostKeyCallback = callback
+	case dest.InsecureIgnoreHostKey:
+		log.Warningf("SFTP '%s' host key is not verified (insecure_ignore_host_key is set)", dest.Host)
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, fmt.Errorf("sftp destination known_hosts not set (set insecure_ignore_host_key to skip host key check)")
+	}
+
+	port := dest.Port
+	if port == 0 {
+		port = sftpDefaultPort
+	}
+
+	return &SFTPUploader{
+		addr:         net.JoinHostPort(dest.Host, strconv.Itoa(port)),
+		remoteDir:    dest.RemoteDir,
+		atomicRename: dest.AtomicRename,
+		sshConfig: &ssh.ClientConfig{
+			User:            dest.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sftpDialTimeout}}, nil
+}
+
+func (up *SFTPUploader) String() string {
+	return fmt.Sprintf("sftp://%s@%s/%s", up.sshConfig.User, up.addr, up.remoteDir)
+}
+
+// Close do nothing, connection is opened for every upload
+func (up *SFTPUploader) Close() error {
+	return nil
+}
+
+// Check open SFTP session and create remote dir
+func (up *SFTPUploader) Check(ctx context.Context) error {
+	client, err := up.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+// Upload save the file into the remote dir (remote dir is created if not exists)
+func (up *SFTPUploader) Upload(ctx context.Context, filePath string) error {
+	client, err := up.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	inFile, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open file '%s' error: %s", filePath, err)
+	}
+	defer inFile.Close()
+
+	fileOnSFTP := remotePath(up.remoteDir, filePath)
+	storeName := fileOnSFTP
+	if up.atomicRename {
+		storeName = fileOnSFTP + partSuffix
+	}
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("Uploading file to SFTP '%s'", storeName)
+
+	outFile, err := client.Create(storeName)
+	if err != nil {
+		return fmt.Errorf("SFTP '%s' create file '%s' error: %s", up.addr, storeName, err)
+	}
+
+	if _, err = io.Copy(outFile, &contextReader{ctx: ctx, r: inFile}); err != nil {
+		outFile.Close()
+		client.Remove(storeName)
+		return fmt.Errorf("upload file on SFTP '%s' error: %s", up.addr, err)
+	}
+	if err = outFile.Close(); err != nil {
+		client.Remove(storeName)
+		return fmt.Errorf("SFTP '%s' close file '%s' error: %s", up.addr, storeName, err)
+	}
+
+	if up.atomicRename {
+		if err = client.replace(storeName, fileOnSFTP); err != nil {
+			client.Remove(storeName)
+			return fmt.Errorf("SFTP '%s' rename '%s' error: %s", up.addr, storeName, err)
+		}
+	}
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("File saved on SFTP")
+	return nil
+}
+
+// connect open SFTP session and create remote dir, closing the client closes the connection.
+// Connection is canceled when ctx is done.
+func (up *SFTPUploader) connect(ctx context.Context) (*sftpClient, error) {
+	log.Infof("Connecting to SFTP %s ...", up.addr)
+
+	dialer := net.Dialer{Timeout: sftpDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", up.addr)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP '%s' open connection error: %s", up.addr, err)
+	}
+
+	// SSH handshake doesn't take ctx: it is limited by the dial timeout and the connection
+	// is closed if ctx is done before the handshake is finished
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(sftpDialTimeout))
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, up.addr, up.sshConfig)
+	close(handshakeDone)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SFTP '%s' open connection error: %s", up.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	sshConn := ssh.NewClient(clientConn, channels, requests)
+
+	client, err := sftp.NewClient(sshConn)
+	if err != nil {
+		sshConn.Close()
+		return nil, fmt.Errorf("SFTP '%s' start session error: %s", up.addr, err)
+	}
+
+	if up.remoteDir != "" {
+		if err = client.MkdirAll(up.remoteDir); err != nil {
+			client.Close()
+			sshConn.Close()
+			return nil, fmt.Errorf("SFTP '%s' create dir '%s' error: %s", up.addr, up.remoteDir, err)
+		}
+	}
+	return &sftpClient{Client: client, conn: sshConn}, nil
+}
+
+// sftpClient is SFTP session with its SSH connection
+type sftpClient struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+// replace rename the file replacing the existing one: with posix-rename extension if the server has it,
+// otherwise the existing file is removed first (plain SFTP rename fails if the target exists)
+func (client *sftpClient) replace(oldName, newName string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldName, newName)
+	}
+	if err := client.Remove(newName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.Rename(oldName, newName)
+}
+
+// Close close SFTP session and SSH connection
+func (client *sftpClient) Close() error {
+	err := client.Client.Close()
+	if cerr := client.conn.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
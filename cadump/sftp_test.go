@@ -0,0 +1,246 @@
+package cadump_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"cadump/cadump"
+)
+
+// ----- Test SFTP server ---
+
+// testSFTPServer is in-process SSH server with "sftp" subsystem on the local port
+type testSFTPServer struct {
+	net.Listener
+	hostKey ssh.PublicKey
+}
+
+// startSFTPServer run SFTP server accepting the user with the password
+func startSFTPServer(t *testing.T, user, password string) *testSFTPServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	ok(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if conn.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	return &testSFTPServer{Listener: listener, hostKey: signer.PublicKey()}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				// payload is SSH string: uint32 length + "sftp"
+				req.Reply(req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		server.Close()
+	}
+}
+
+// dest return SFTP destination of the server with the password and known_hosts file
+func (server *testSFTPServer) dest(t *testing.T, password, knownHosts string) cadump.DestinationConfig {
+	host, port, err := net.SplitHostPort(server.Addr().String())
+	ok(t, err)
+	portNum, err := strconv.Atoi(port)
+	ok(t, err)
+
+	return cadump.DestinationConfig{
+		Type: "sftp", Host: host, Port: portNum, User: "cadump", Password: password, KnownHosts: knownHosts}
+}
+
+// knownHosts save known_hosts file with the host key for the server address
+func (server *testSFTPServer) knownHosts(t *testing.T, folder string, hostKey ssh.PublicKey) string {
+	path := filepath.Join(folder, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr().String())}, hostKey)
+	ok(t, ioutil.WriteFile(path, []byte(line+"\n"), 0644))
+	return path
+}
+
+// ----- Tests -----
+
+func TestSFTPUploader(t *testing.T) {
+	server := startSFTPServer(t, "cadump", "secret")
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	dest := server.dest(t, "secret", server.knownHosts(t, filepath.Dir(filePath), server.hostKey))
+	dest.RemoteDir = filepath.Join(filepath.Dir(filePath), "sftp", "upload")
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+	ok(t, uploader.Upload(context.Background(), filePath))
+
+	data, err := ioutil.ReadFile(filepath.Join(dest.RemoteDir, "rooms-42.csv"))
+	ok(t, err)
+	equals(t, testFileContent, string(data))
+}
+
+func TestSFTPUploader_AtomicRename(t *testing.T) {
+	server := startSFTPServer(t, "cadump", "secret")
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	dest := server.dest(t, "secret", server.knownHosts(t, filepath.Dir(filePath), server.hostKey))
+	dest.RemoteDir = filepath.Join(filepath.Dir(filePath), "upload")
+	dest.AtomicRename = true
+
+	// file of the previous upload is replaced
+	ok(t, os.MkdirAll(dest.RemoteDir, 0755))
+	ok(t, ioutil.WriteFile(filepath.Join(dest.RemoteDir, "rooms-42.csv"), []byte("old"), 0644))
+
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+	ok(t, uploader.Upload(context.Background(), filePath))
+
+	data, err := ioutil.ReadFile(filepath.Join(dest.RemoteDir, "rooms-42.csv"))
+	ok(t, err)
+	equals(t, testFileContent, string(data))
+	_, err = os.Stat(filepath.Join(dest.RemoteDir, "rooms-42.csv.part"))
+	equals(t, true, os.IsNotExist(err))
+}
+
+func TestSFTPUploader_WrongPassword(t *testing.T) {
+	server := startSFTPServer(t, "cadump", "secret")
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	dest := server.dest(t, "wrong", "")
+	dest.InsecureIgnoreHostKey = true
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+
+	err = uploader.Upload(context.Background(), filePath)
+	equals(t, true, err != nil)
+}
+
+func TestSFTPUploader_HostKey(t *testing.T) {
+	server := startSFTPServer(t, "cadump", "secret")
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	// host key is required by default
+	_, err := cadump.NewUploader(server.dest(t, "secret", ""))
+	equals(t, "sftp destination known_hosts not set (set insecure_ignore_host_key to skip host key check)",
+		err.Error())
+
+	// host key is checked
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	ok(t, err)
+	knownHosts := server.knownHosts(t, filepath.Dir(filePath), otherSigner.PublicKey())
+
+	uploader, err := cadump.NewUploader(server.dest(t, "secret", knownHosts))
+	ok(t, err)
+	err = uploader.Upload(context.Background(), filePath)
+	equals(t, true, strings.Contains(err.Error(), "key mismatch"))
+
+	// check is skipped only explicitly
+	dest := server.dest(t, "secret", "")
+	dest.InsecureIgnoreHostKey = true
+	dest.RemoteDir = filepath.Join(filepath.Dir(filePath), "upload")
+	uploader, err = cadump.NewUploader(dest)
+	ok(t, err)
+	ok(t, uploader.Upload(context.Background(), filePath))
+}
+
+func TestSFTPUploader_Canceled(t *testing.T) {
+	server := startSFTPServer(t, "cadump", "secret")
+	defer server.Close()
+
+	filePath, cleanup := testFile(t)
+	defer cleanup()
+
+	dest := server.dest(t, "secret", "")
+	dest.InsecureIgnoreHostKey = true
+	uploader, err := cadump.NewUploader(dest)
+	ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = uploader.Upload(ctx, filePath)
+	equals(t, "SFTP '"+server.Addr().String()+"' open connection error: dial tcp "+server.Addr().String()+
+		": operation was canceled", err.Error())
+}
+
+func TestSFTPUploader_Check(t *testing.T) {
+	server := startSFTPServer(t, "cadump", "secret")
+	defer server.Close()
+
+	tmpFolder, err := ioutil.TempDir("", "cadump-sftp")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	dest := server.dest(t, "secret", server.knownHosts(t, tmpFolder, server.hostKey))
+	dest.RemoteDir = filepath.Join(tmpFolder, "upload")
+	uploader, err := cadump.NewSFTPUploader(dest)
+	ok(t, err)
+	ok(t, uploader.Check(context.Background()))
+
+	// remote dir is created
+	_, err = os.Stat(dest.RemoteDir)
+	ok(t, err)
+}
@@ -0,0 +1,313 @@
+package cadump
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	httpUploadTimeout = 10 * time.Minute
+	partSuffix        = ".part" // suffix of the file being uploaded in atomic rename mode
+)
+
+// ----- Uploader -----
+
+// Uploader delivers output file to the destination
+type Uploader interface {
+	// Upload save the file on the destination under its base name.
+	// Upload is interrupted when ctx is done, partially uploaded file is removed if it is possible.
+	Upload(ctx context.Context, filePath string) error
+	// String return destination name for logs
+	String() string
+	// Close release destination connection
+	Close() error
+}
+
+// NewUploader create Uploader for the destination config
+func NewUploader(dest DestinationConfig) (Uploader, error) {
+	switch strings.ToLower(dest.Type) {
+	case "ftp":
+		return NewFTPUploader(dest)
+	case "sftp":
+		return NewSFTPUploader(dest)
+	case "s3":
+		return NewS3Uploader(dest)
+	case "local":
+		return NewLocalUploader(dest)
+	case "http":
+		return NewHTTPUploader(dest)
+	default:
+		return nil, fmt.Errorf("unknown destination type '%s'", dest.Type)
+	}
+}
+
+// NewUploaders create uploaders for all configured destinations (including legacy FTP section)
+func NewUploaders(config Config) ([]Uploader, error) {
+	var uploaders []Uploader
+
+	destinations := config.Destinations
+	if config.FTP.Host != "" {
+		ftpDest := config.FTP
+		ftpDest.Type = "ftp"
+		destinations = append([]DestinationConfig{ftpDest}, destinations...)
+	}
+
+	for i, dest := range destinations {
+		uploader, err := NewUploader(dest)
+		if err != nil {
+			return nil, fmt.Errorf("destination #%d config error: %s", i+1, err)
+		}
+		uploaders = append(uploaders, uploader)
+	}
+	return uploaders, nil
+}
+
+// UploadFiles deliver every file to all destinations
+func UploadFiles(ctx context.Context, files []string, uploaders []Uploader) error {
+	for _, uploader := range uploaders {
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := uploader.Upload(ctx, file); err != nil {
+				return fmt.Errorf("upload '%s' to %s error: %s", file, uploader, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Checker is uploader which connection to the destination can be tested without upload
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckUploaders test connection to every destination which supports it
+func CheckUploaders(ctx context.Context, uploaders []Uploader) error {
+	for _, uploader := range uploaders {
+		checker, ok := uploader.(Checker)
+		if !ok {
+			LogWith(Fields{"destination": uploader.String()}).Infof("Destination check skipped")
+			continue
+		}
+		if err := checker.Check(ctx); err != nil {
+			return fmt.Errorf("check %s error: %s", uploader, err)
+		}
+		LogWith(Fields{"destination": uploader.String()}).Infof("Destination is available")
+	}
+	return nil
+}
+
+// CloseUploaders close all uploaders, errors are only logged (files are already delivered)
+func CloseUploaders(uploaders []Uploader) {
+	for _, uploader := range uploaders {
+		if err := uploader.Close(); err != nil {
+			LogWith(Fields{"destination": uploader.String()}).Warningf("Close destination error: %s", err)
+		}
+	}
+}
+
+// ----- Local directory -----
+
+// LocalUploader copy files into the local directory
+type LocalUploader struct {
+	dir string
+}
+
+// NewLocalUploader is LocalUploader constructor
+func NewLocalUploader(dest DestinationConfig) (*LocalUploader, error) {
+	if dest.Path == "" {
+		return nil, fmt.Errorf("local destination path not set")
+	}
+	return &LocalUploader{dir: dest.Path}, nil
+}
+
+func (up *LocalUploader) String() string {
+	return fmt.Sprintf("local dir '%s'", up.dir)
+}
+
+// Close do nothing, there is no connection
+func (up *LocalUploader) Close() error {
+	return nil
+}
+
+// Upload copy the file into the directory (directory is created if not exists)
+func (up *LocalUploader) Upload(ctx context.Context, filePath string) (err error) {
+	if err = os.MkdirAll(up.dir, 0755); err != nil {
+		return fmt.Errorf("create dir '%s' error: %s", up.dir, err)
+	}
+
+	inFile, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open file '%s' error: %s", filePath, err)
+	}
+	defer inFile.Close()
+
+	destPath := filepath.Join(up.dir, filepath.Base(filePath))
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("Copying file to '%s'", destPath)
+
+	outFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("create file '%s' error: %s", destPath, err)
+	}
+	defer func() {
+		if ferr := outFile.Close(); ferr != nil && err == nil {
+			err = fmt.Errorf("close file '%s' error: %s", destPath, ferr)
+		}
+		if err != nil {
+			os.Remove(destPath)
+		}
+	}()
+
+	if _, err = io.Copy(outFile, &contextReader{ctx: ctx, r: inFile}); err != nil {
+		return fmt.Errorf("copy file '%s' error: %s", filePath, err)
+	}
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("File saved to '%s'", destPath)
+	return nil
+}
+
+// ----- HTTP -----
+
+// HTTPUploader send files to the HTTP endpoint.
+// PUT sends file body to the "<url>/<file name>", POST sends multipart form with "file" field to the url.
+type HTTPUploader struct {
+	url     string
+	method  string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewHTTPUploader is HTTPUploader constructor
+func NewHTTPUploader(dest DestinationConfig) (*HTTPUploader, error) {
+	if dest.URL == "" {
+		return nil, fmt.Errorf("http destination url not set")
+	}
+
+	method := strings.ToUpper(dest.Method)
+	if method == "" {
+		method = http.MethodPut
+	}
+	if method != http.MethodPut && method != http.MethodPost {
+		return nil, fmt.Errorf("http destination method '%s' not supported (use PUT or POST)", dest.Method)
+	}
+
+	return &HTTPUploader{
+		url:     dest.URL,
+		method:  method,
+		headers: dest.Headers,
+		client:  &http.Client{Timeout: httpUploadTimeout}}, nil
+}
+
+func (up *HTTPUploader) String() string {
+	return fmt.Sprintf("%s %s", up.method, up.url)
+}
+
+// Close release idle HTTP connections
+func (up *HTTPUploader) Close() error {
+	up.client.CloseIdleConnections()
+	return nil
+}
+
+// Upload send the file with configured method
+func (up *HTTPUploader) Upload(ctx context.Context, filePath string) error {
+	inFile, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open file '%s' error: %s", filePath, err)
+	}
+	defer inFile.Close()
+
+	fileName := filepath.Base(filePath)
+
+	var req *http.Request
+	if up.method == http.MethodPut {
+		stat, err := inFile.Stat()
+		if err != nil {
+			return fmt.Errorf("stat file '%s' error: %s", filePath, err)
+		}
+		req, err = http.NewRequestWithContext(
+			ctx, http.MethodPut, strings.TrimSuffix(up.url, "/")+"/"+fileName, inFile)
+		if err != nil {
+			return fmt.Errorf("create HTTP request error: %s", err)
+		}
+		req.ContentLength = stat.Size()
+		req.Header.Set("Content-Type", "application/octet-stream")
+	} else {
+		body, contentType := multipartBody(inFile, fileName)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, up.url, body)
+		if err != nil {
+			return fmt.Errorf("create HTTP request error: %s", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	for name, value := range up.headers {
+		req.Header.Set(name, value)
+	}
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("Uploading file to %s", req.URL)
+	resp, err := up.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP upload error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("HTTP upload error: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	LogWith(Fields{"file": filePath, "destination": up.String()}).Infof("File sent to %s", req.URL)
+	return nil
+}
+
+// multipartBody stream file as multipart form "file" field
+func multipartBody(file io.Reader, fileName string) (io.Reader, string) {
+	bodyReader, bodyWriter := io.Pipe()
+	form := multipart.NewWriter(bodyWriter)
+
+	go func() {
+		part, err := form.CreateFormFile("file", fileName)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	return bodyReader, form.FormDataContentType()
+}
+
+// ----- Helpers -----
+
+// contextReader stop reading with the context error when the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// remotePath join remote dir (with "/" separator) and base name of the local file
+func remotePath(dir string, filePath string) string {
+	fileName := filepath.Base(filePath)
+	if dir == "" {
+		return fileName
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + fileName
+}
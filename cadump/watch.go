@@ -0,0 +1,284 @@
+package cadump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultWatchInterval    = time.Minute
+	defaultWatchColumn      = "scan_id"
+	defaultWatchStateFile   = "cadump-watch.json"
+	defaultWatchMaxAttempts = 5
+)
+
+// ScanLister select IDs of the finished scans, CassandraReader is the default one
+type ScanLister interface {
+	SelectScanIDs(ctx context.Context, query string, values ...interface{}) ([]uint, error)
+}
+
+// WithScanLister set finished scans source of Watch instead of CassandraReader
+func WithScanLister(lister ScanLister) Option {
+	return func(run *runner) {
+		run.lister = lister
+	}
+}
+
+// ----- Watch -----
+
+// Watch poll finished scans every cfg.Watch.Interval and export every new scan with Run.
+// Exported scans are saved in the state file, so every scan is exported once even after restart.
+// Failed exports are counted in the state file too: failed scan is exported again on the next poll,
+// then the delay doubles after every failure, and after cfg.Watch.MaxAttempts failures the scan is skipped.
+// Watch stops without error when ctx is done, interrupted export is removed and done again on the next start.
+// Export metrics are served on cfg.Metrics.Listen address if it is set.
+//
+// Example:
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+//	defer stop()
+//	return cadump.Watch(ctx, config)
+func Watch(ctx context.Context, cfg Config, options ...Option) error {
+	deps := &runner{}
+	for _, option := range options {
+		option(deps)
+	}
+
+	query, values, err := cfg.Watch.ScanIDsQuery()
+	if err != nil {
+		return stageError(StageConfig, err)
+	}
+
+	poll := &watchPoll{query: query, values: values, now: time.Now, maxAttempts: cfg.Watch.MaxAttempts}
+	if deps.now != nil {
+		poll.now = deps.now
+	}
+	if poll.maxAttempts <= 0 {
+		poll.maxAttempts = defaultWatchMaxAttempts
+	}
+
+	statePath := cfg.Watch.StateFile
+	if statePath == "" {
+		statePath = filepath.Join(cfg.TMPFolder, defaultWatchStateFile)
+	}
+	state, err := LoadWatchState(statePath)
+	if err != nil {
+		return stageError(StageConfig, err)
+	}
+
+	interval := cfg.Watch.Interval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	poll.interval = interval
+
+	if deps.reader == nil || deps.lister == nil {
+		// single Cassandra session for both scans list and scans data
+		db := NewCassandraReader(cfg.Cassandra)
+		defer db.Close()
+
+		if deps.reader == nil {
+			deps.reader = db
+			options = append(options, WithReader(db))
+		}
+		if deps.lister == nil {
+			deps.lister = db
+		}
+	}
+
+	if cfg.CheckpointRows > 0 {
+		// failed export is continued on the next poll
+		options = append(options, WithResume())
+	}
+
+	if cfg.Metrics.Listen != "" {
+		go func() {
+			if err := ServeMetrics(ctx, cfg.Metrics.Listen); err != nil {
+				log.Errorf("%s", err)
+			}
+		}()
+	}
+
+	LogWith(Fields{"file": statePath}).Infof("Watching finished scans every %s", interval)
+
+	for {
+		if err := watchScans(ctx, cfg, deps.lister, poll, state, options); err != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			log.Info("Watch stopped")
+			return nil
+		}
+	}
+}
+
+// watchPoll is the finished scans query and the retry settings of the failed scans
+type watchPoll struct {
+	query       string
+	values      []interface{}
+	interval    time.Duration
+	maxAttempts int
+	now         func() time.Time
+}
+
+// retry return true if the failed scan should be exported on this poll: the first retry is on the next
+// poll, then the delay doubles after every failure (interval, 2 * interval, ...) until maxAttempts
+func (poll *watchPoll) retry(failure *WatchFailure) bool {
+	if failure == nil {
+		return true
+	}
+	if failure.Attempts >= poll.maxAttempts {
+		return false
+	}
+	delay := poll.interval*time.Duration(1<<uint(failure.Attempts-1)) - poll.interval
+	return !poll.now().Before(failure.Last.Add(delay))
+}
+
+// watchScans export new scans one by one, returned error stops the watch
+func watchScans(ctx context.Context, cfg Config, lister ScanLister, poll *watchPoll, state *WatchState,
+	options []Option) error {
+
+	scanIDs, err := lister.SelectScanIDs(ctx, poll.query, poll.values...)
+	if err != nil {
+		if ctx.Err() == nil {
+			stage, _ := ErrorStage(err)
+			LogWith(Fields{"stage": stage}).Errorf("Poll finished scans error: %s", err)
+		}
+		return nil
+	}
+
+	sort.Slice(scanIDs, func(i, j int) bool { return scanIDs[i] < scanIDs[j] })
+
+	for i, scanID := range scanIDs {
+		if scanID <= cfg.Watch.MinScanID || state.IsDone(scanID) || (i > 0 && scanIDs[i-1] == scanID) {
+			continue
+		}
+		if !poll.retry(state.Failed[scanID]) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		scanLog := LogWith(Fields{"scan_id": scanID})
+		scanLog.Infof("New finished scan found")
+		report, err := Run(ctx, cfg, []uint{scanID}, options...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			stage, _ := ErrorStage(err)
+			attempts, serr := state.MarkFailed(scanID, poll.now())
+			if serr != nil {
+				return stageError(StageWrite, serr)
+			}
+			if attempts >= poll.maxAttempts {
+				scanLog.With(Fields{"stage": stage}).Errorf(
+					"Export failed %d times, giving up (remove the scan from failed in the state file to retry): %s",
+					attempts, err)
+			} else {
+				scanLog.With(Fields{"stage": stage}).Errorf("Export failed (attempt %d of %d), retry later: %s",
+					attempts, poll.maxAttempts, err)
+			}
+			continue
+		}
+
+		// exported scan must not be exported again, stop if it can't be recorded
+		if err = state.MarkDone(scanID, report.End); err != nil {
+			return stageError(StageWrite, err)
+		}
+	}
+	return nil
+}
+
+// ----- Watch state -----
+
+// WatchState is the set of exported scans and failed exports saved in the JSON file
+type WatchState struct {
+	path   string
+	Done   map[uint]time.Time     `json:"done"` // export end time of the scan
+	Failed map[uint]*WatchFailure `json:"failed,omitempty"`
+}
+
+// WatchFailure is the number of failed exports of the scan and the time of the last one
+type WatchFailure struct {
+	Attempts int       `json:"attempts"`
+	Last     time.Time `json:"last"`
+}
+
+// LoadWatchState read state file, missing file is empty state
+func LoadWatchState(path string) (*WatchState, error) {
+	state := &WatchState{path: path, Done: make(map[uint]time.Time), Failed: make(map[uint]*WatchFailure)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read watch state error: %s", err)
+	}
+
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parse watch state '%s' error: %s", path, err)
+	}
+	if state.Done == nil {
+		state.Done = make(map[uint]time.Time)
+	}
+	if state.Failed == nil {
+		state.Failed = make(map[uint]*WatchFailure)
+	}
+	return state, nil
+}
+
+// IsDone return true if the scan was exported
+func (state *WatchState) IsDone(scanID uint) bool {
+	_, done := state.Done[scanID]
+	return done
+}
+
+// MarkDone add scan to the state, remove its failures and save the state file
+func (state *WatchState) MarkDone(scanID uint, end time.Time) error {
+	state.Done[scanID] = end
+	delete(state.Failed, scanID)
+	return state.save()
+}
+
+// MarkFailed count failed export of the scan and save the state file, number of failures is returned
+func (state *WatchState) MarkFailed(scanID uint, at time.Time) (int, error) {
+	failure := state.Failed[scanID]
+	if failure == nil {
+		failure = &WatchFailure{}
+		state.Failed[scanID] = failure
+	}
+	failure.Attempts++
+	failure.Last = at
+	return failure.Attempts, state.save()
+}
+
+// save write the state file, it is replaced atomically, so it is never left half-written
+func (state *WatchState) save() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("serialize watch state error: %s", err)
+	}
+
+	tmpPath := state.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("save watch state '%s' error: %s", state.path, err)
+	}
+	if err = os.Rename(tmpPath, state.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("save watch state '%s' error: %s", state.path, err)
+	}
+	return nil
+}
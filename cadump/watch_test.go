@@ -0,0 +1,183 @@
+package cadump_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cadump/cadump"
+)
+
+// ----- Test vars ---
+
+// testLister return prepared scan IDs and stop the watch after the polls
+type testLister struct {
+	polls   [][]uint
+	queries []string
+	values  [][]interface{}
+	cancel  func()
+}
+
+func (lister *testLister) SelectScanIDs(ctx context.Context, query string, values ...interface{}) ([]uint, error) {
+	lister.queries = append(lister.queries, query)
+	lister.values = append(lister.values, values)
+	if len(lister.polls) == 0 {
+		lister.cancel()
+		return nil, ctx.Err()
+	}
+
+	scanIDs := lister.polls[0]
+	lister.polls = lister.polls[1:]
+	if scanIDs == nil {
+		return nil, fmt.Errorf("connection lost")
+	}
+	return scanIDs, nil
+}
+
+// ----- Tests -----
+
+func TestWatch(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-watch")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rows := map[uint][]cadump.ScanDataTable{40: {scanDataRow()}, 42: {scanDataRow()}, 43: {scanDataRow()}}
+	lister := &testLister{polls: [][]uint{{43, 42, 40, 42}, nil, {42, 43, 44}}, cancel: cancel}
+	uploader := &testUploader{files: make(map[string]string)}
+
+	statePath := filepath.Join(tmpFolder, "state.json")
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true, Watch: cadump.WatchConfig{
+		Table: "scans", Where: map[string]interface{}{"status": "finished"}, Interval: time.Millisecond,
+		StateFile: statePath, MinScanID: 40}}
+
+	err = cadump.Watch(ctx, config, cadump.WithScanLister(lister), cadump.WithReader(&testReader{scans: rows}),
+		cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+
+	equals(t, []interface{}{"finished"}, lister.values[0])
+	equals(t, 4, len(lister.queries))
+
+	// scan 40 is ignored, scan 44 has no rooms
+	for _, name := range []string{"rooms-2020_05_01-10_00_00-Marriott-42.csv",
+		"rooms-2020_05_01-10_00_00-Marriott-43.csv", "hotels_counts-2020_05_01-10_00_00-44.csv"} {
+		_, exists := uploader.files[name]
+		equals(t, true, exists)
+	}
+	_, exists := uploader.files["rooms-2020_05_01-10_00_00-Marriott-40.csv"]
+	equals(t, false, exists)
+
+	state, err := cadump.LoadWatchState(statePath)
+	ok(t, err)
+	equals(t, map[uint]time.Time{42: testClock(), 43: testClock(), 44: testClock()}, state.Done)
+
+	// exported scans are not exported again after restart
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	lister = &testLister{polls: [][]uint{{42, 43, 44}}, cancel: cancel}
+	uploader = &testUploader{files: make(map[string]string)}
+
+	err = cadump.Watch(ctx, config, cadump.WithScanLister(lister), cadump.WithReader(&testReader{scans: rows}),
+		cadump.WithUploaders(uploader), cadump.WithClock(testClock))
+	ok(t, err)
+	equals(t, 0, len(uploader.files))
+}
+
+func TestWatch_FailedScan(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-watch")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	reader := &testReader{err: fmt.Errorf("read timeout")}
+	statePath := filepath.Join(tmpFolder, "state.json")
+	config := cadump.Config{TMPFolder: tmpFolder, RemoveTMPFiles: true, Watch: cadump.WatchConfig{
+		Query: "SELECT scan_id FROM scans", Interval: time.Millisecond, StateFile: statePath}}
+
+	// clock stands still: the first retry is on the next poll, the second one waits for the interval
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lister := &testLister{polls: [][]uint{{45}, {45}, {45}}, cancel: cancel}
+	err = cadump.Watch(ctx, config, cadump.WithScanLister(lister), cadump.WithReader(reader),
+		cadump.WithUploaders(), cadump.WithClock(testClock))
+	ok(t, err)
+
+	state, err := cadump.LoadWatchState(statePath)
+	ok(t, err)
+	equals(t, map[uint]*cadump.WatchFailure{45: {Attempts: 2, Last: testClock()}}, state.Failed)
+
+	// clock runs: scan is retried until max attempts and skipped after that
+	ok(t, os.Remove(statePath))
+	config.Watch.MaxAttempts = 2
+	now := testClock()
+	clock := func() time.Time {
+		now = now.Add(time.Hour)
+		return now
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	lister = &testLister{polls: [][]uint{{45}, {45}, {45}, {45}}, cancel: cancel}
+	err = cadump.Watch(ctx, config, cadump.WithScanLister(lister), cadump.WithReader(reader),
+		cadump.WithUploaders(), cadump.WithClock(clock))
+	ok(t, err)
+
+	state, err = cadump.LoadWatchState(statePath)
+	ok(t, err)
+	equals(t, 2, state.Failed[45].Attempts)
+	equals(t, false, state.IsDone(45))
+	lastFailure := state.Failed[45].Last
+
+	// scan is exported with more attempts allowed, failures are removed
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	lister = &testLister{polls: [][]uint{{45}}, cancel: cancel}
+	config.Watch.MaxAttempts = 3
+	rows := map[uint][]cadump.ScanDataTable{45: {scanDataRow()}}
+	err = cadump.Watch(ctx, config, cadump.WithScanLister(lister), cadump.WithReader(&testReader{scans: rows}),
+		cadump.WithUploaders(), cadump.WithClock(clock))
+	ok(t, err)
+
+	state, err = cadump.LoadWatchState(statePath)
+	ok(t, err)
+	equals(t, true, state.IsDone(45))
+	equals(t, 0, len(state.Failed))
+	equals(t, true, lastFailure.Before(state.Done[45]))
+}
+
+func TestWatch_ConfigError(t *testing.T) {
+	err := cadump.Watch(context.Background(), cadump.Config{}, cadump.WithScanLister(&testLister{}))
+
+	stage, _ := cadump.ErrorStage(err)
+	equals(t, cadump.StageConfig, stage)
+	equals(t, "config error: WATCH query or table not set", err.Error())
+}
+
+func TestLoadWatchState_Broken(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-watch")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	statePath := filepath.Join(tmpFolder, "state.json")
+	ok(t, ioutil.WriteFile(statePath, []byte("{"), 0644))
+
+	_, err = cadump.LoadWatchState(statePath)
+	equals(t, fmt.Sprintf("parse watch state '%s' error: unexpected end of JSON input", statePath), err.Error())
+}
+
+func TestWatchConfig_ScanIDsQuery(t *testing.T) {
+	query, values, err := cadump.WatchConfig{Query: "SELECT id FROM finished", Table: "scans"}.ScanIDsQuery()
+	ok(t, err)
+	equals(t, "SELECT id FROM finished", query)
+	equals(t, 0, len(values))
+
+	// where values are bound in the order of the sorted columns
+	_, values, err = cadump.WatchConfig{Table: "scans", Column: "id",
+		Where: map[string]interface{}{"status": "finished", "kind": 2}}.ScanIDsQuery()
+	ok(t, err)
+	equals(t, []interface{}{2, "finished"}, values)
+}
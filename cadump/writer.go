@@ -0,0 +1,314 @@
+package cadump
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Output file formats
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+	FormatXLSX    = "xlsx"
+)
+
+// Outputs of the run
+const (
+	OutputRooms        = "rooms"
+	OutputHotelsCounts = "hotels_counts"
+)
+
+// ----- Writer -----
+
+// Writer save rows batch by batch into the file.
+// Rows are slice of structs with "csv" tags (tags are column names) or Table.
+type Writer interface {
+	Write(rows interface{}) error
+	FileName() string
+	Close() error
+}
+
+// Table is rows with dynamic columns
+type Table interface {
+	Header() []string
+	Records() [][]interface{}
+}
+
+// WriterFactory create writer of the output, file extension is added to the base path
+type WriterFactory func(output string, basePath string) (Writer, error)
+
+// NewWriter create writer of the format (CSV by default), format extension is added to the base path.
+// Compression is used only by CSV and JSONL writers, Parquet and XLSX files are compressed by themselves.
+func NewWriter(format string, basePath string, compression string) (Writer, error) {
+	switch strings.ToLower(format) {
+	case "", FormatCSV:
+		return NewCSVWriter(basePath+".csv", compression)
+	case FormatJSONL:
+		return NewJSONLWriter(basePath+".jsonl", compression)
+	case FormatParquet:
+		return NewParquetWriter(basePath + ".parquet")
+	case FormatXLSX:
+		return NewXLSXWriter(basePath+".xlsx", "Channel")
+	default:
+		return nil, fmt.Errorf("unknown output format '%s'", format)
+	}
+}
+
+// offsetWriter is Writer of the file which can be continued from the offset after restart
+type offsetWriter interface {
+	Writer
+	Offset() (int64, error)
+}
+
+// appendWriter open file of the format (CSV by default) for writing from the offset, data after it is removed.
+// Only uncompressed CSV and JSONL files can be continued.
+func appendWriter(format string, fileName string, offset int64) (offsetWriter, error) {
+	switch strings.ToLower(format) {
+	case "", FormatCSV:
+		return appendCSVWriter(fileName, offset)
+	case FormatJSONL:
+		return appendJSONLWriter(fileName, offset)
+	default:
+		return nil, fmt.Errorf("output format '%s' can't be continued", format)
+	}
+}
+
+// OutputFileName return name of the file NewWriter create for the format, base path and compression
+func OutputFileName(format string, basePath string, compression string) (string, error) {
+	var fileName string
+	switch strings.ToLower(format) {
+	case "", FormatCSV:
+		fileName, _ = compressedFileName(basePath+".csv", compression)
+	case FormatJSONL:
+		fileName, _ = compressedFileName(basePath+".jsonl", compression)
+	case FormatParquet:
+		fileName = basePath + ".parquet"
+	case FormatXLSX:
+		fileName = basePath + ".xlsx"
+	default:
+		return "", fmt.Errorf("unknown output format '%s'", format)
+	}
+	return fileName, nil
+}
+
+// checkFormat return error if the format is not supported
+func checkFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", FormatCSV, FormatJSONL, FormatParquet, FormatXLSX:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format '%s' (use csv, jsonl, parquet or xlsx)", format)
+	}
+}
+
+// ----- JSON Lines -----
+
+// JSONLWriter save every row as JSON object on the separate line, object keys are column names
+type JSONLWriter struct {
+	fileName string
+	outFile  *compressedFile
+	buf      *bufio.Writer
+}
+
+// NewJSONLWriter is JSONLWriter constructor, compression is the same as of CSVWriter
+func NewJSONLWriter(filePath string, compression string) (*JSONLWriter, error) {
+	if err := checkCompression(compression); err != nil {
+		return nil, err
+	}
+
+	fileName, entryName := compressedFileName(filePath, compression)
+	outFile, err := createCompressedFile(fileName, entryName, compression)
+	if err != nil {
+		return nil, fmt.Errorf("create JSONL file '%s' error: %s", fileName, err)
+	}
+
+	return &JSONLWriter{
+		fileName: fileName,
+		outFile:  outFile,
+		buf:      bufio.NewWriter(outFile)}, nil
+}
+
+// appendJSONLWriter open uncompressed JSONL file and continue it from the offset
+func appendJSONLWriter(fileName string, offset int64) (*JSONLWriter, error) {
+	outFile, err := openAppendFile(fileName, offset)
+	if err != nil {
+		return nil, fmt.Errorf("open JSONL file '%s' error: %s", fileName, err)
+	}
+
+	return &JSONLWriter{
+		fileName: fileName,
+		outFile:  outFile,
+		buf:      bufio.NewWriter(outFile)}, nil
+}
+
+// FileName return name of the file the rows are saved to
+func (writer *JSONLWriter) FileName() string {
+	return writer.fileName
+}
+
+// Write append rows to the file
+func (writer *JSONLWriter) Write(rows interface{}) error {
+	columns, records, err := rowsRecords(rows)
+	if err != nil {
+		return fmt.Errorf("serilize rows into JSONL file '%s' error: %s", writer.fileName, err)
+	}
+
+	for _, record := range records {
+		line, err := jsonRecord(columns, record)
+		if err != nil {
+			return fmt.Errorf("serilize rows into JSONL file '%s' error: %s", writer.fileName, err)
+		}
+		writer.buf.Write(line)
+		if err = writer.buf.WriteByte('\n'); err != nil {
+			return fmt.Errorf("write JSONL file '%s' error: %s", writer.fileName, err)
+		}
+	}
+	return nil
+}
+
+// Offset flush written rows and return size of the uncompressed file
+func (writer *JSONLWriter) Offset() (int64, error) {
+	if err := writer.buf.Flush(); err != nil {
+		return 0, fmt.Errorf("write JSONL file '%s' error: %s", writer.fileName, err)
+	}
+	offset, err := writer.outFile.offset()
+	if err != nil {
+		return 0, fmt.Errorf("JSONL file '%s' offset error: %s", writer.fileName, err)
+	}
+	return offset, nil
+}
+
+// Close flush all data and close the file
+func (writer *JSONLWriter) Close() error {
+	err := writer.buf.Flush()
+	if cerr := writer.outFile.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("close JSONL file '%s' error: %s", writer.fileName, err)
+	}
+	return nil
+}
+
+// ----- Dry run -----
+
+// dryRunWriter only keeps the name of the file, nothing is written
+type dryRunWriter struct {
+	fileName string
+}
+
+func (writer *dryRunWriter) FileName() string {
+	return writer.fileName
+}
+
+func (writer *dryRunWriter) Write(rows interface{}) error {
+	return nil
+}
+
+func (writer *dryRunWriter) Close() error {
+	return nil
+}
+
+// ----- Rows helpers -----
+
+// column is output column, name is "csv" tag of the struct field
+type column struct {
+	name     string
+	kind     reflect.Kind
+	optional bool // nil values are allowed
+}
+
+// rowsRecords convert rows (slice of structs with "csv" tags or Table) into columns and records.
+// Pointer fields are dereferenced, nil pointer is nil value.
+func rowsRecords(rows interface{}) ([]column, [][]interface{}, error) {
+	if table, ok := rows.(Table); ok {
+		return tableRecords(table)
+	}
+
+	value := reflect.ValueOf(rows)
+	if value.Kind() != reflect.Slice || value.Type().Elem().Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("rows must be slice of structs, got %T", rows)
+	}
+
+	var columns []column
+	var fields []int
+
+	rowType := value.Type().Elem()
+	for fnum := 0; fnum < rowType.NumField(); fnum++ {
+		field := rowType.Field(fnum)
+		name := field.Tag.Get("csv")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		col := column{name: name, kind: field.Type.Kind()}
+		if col.kind == reflect.Ptr {
+			col.kind, col.optional = field.Type.Elem().Kind(), true
+		}
+		columns = append(columns, col)
+		fields = append(fields, fnum)
+	}
+
+	records := make([][]interface{}, value.Len())
+	for i := range records {
+		row := value.Index(i)
+		record := make([]interface{}, len(fields))
+		for j, fnum := range fields {
+			field := row.Field(fnum)
+			if field.Kind() == reflect.Ptr {
+				if field.IsNil() {
+					continue
+				}
+				field = field.Elem()
+			}
+			record[j] = field.Interface()
+		}
+		records[i] = record
+	}
+	return columns, records, nil
+}
+
+// tableRecords return table columns with the kinds of the first record values (string if there are no records)
+func tableRecords(table Table) ([]column, [][]interface{}, error) {
+	header := table.Header()
+	records := table.Records()
+
+	columns := make([]column, len(header))
+	for i, name := range header {
+		columns[i] = column{name: name, kind: reflect.String}
+		if len(records) > 0 && i < len(records[0]) && records[0][i] != nil {
+			columns[i].kind = reflect.TypeOf(records[0][i]).Kind()
+		}
+	}
+	return columns, records, nil
+}
+
+// jsonRecord encode record as JSON object with keys in the columns order
+func jsonRecord(columns []column, record []interface{}) ([]byte, error) {
+	line := []byte{'{'}
+	for i, col := range columns {
+		key, err := json.Marshal(col.name)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if i < len(record) {
+			value = record[i]
+		}
+		val, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = append(append(append(line, key...), ':'), val...)
+	}
+	return append(line, '}'), nil
+}
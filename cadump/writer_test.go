@@ -0,0 +1,261 @@
+package cadump_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xuri/excelize/v2"
+
+	"cadump/cadump"
+)
+
+// ----- Test vars ---
+
+var testProductNum = uint(7)
+
+func testRooms() []cadump.Room {
+	room1, room2 := Room1("Booking"), Room2("Marriott")
+	room1.LOS, room1.Rate, room1.ProductNum = 2, "120.50", &testProductNum
+	room2.LOS, room2.Rate = 1, "99"
+	return []cadump.Room{room1, room2}
+}
+
+// parquetValues return values of the Parquet row read without schema by the column names.
+// Reader makes struct field names from the column names (e.g. "Product #" is "Product3235"),
+// so the fields are found by the names of the schema. Missing optional values are nil.
+func parquetValues(pr *reader.ParquetReader, row interface{}) map[string]interface{} {
+	values := make(map[string]interface{})
+	for i := 1; i < len(pr.SchemaHandler.Infos); i++ {
+		field := reflect.ValueOf(row).FieldByName(pr.SchemaHandler.Infos[i].InName)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				values[pr.SchemaHandler.GetExName(i)] = nil
+				continue
+			}
+			field = field.Elem()
+		}
+		values[pr.SchemaHandler.GetExName(i)] = field.Interface()
+	}
+	return values
+}
+
+// roomValues return values of the room as they are read from Parquet file
+func roomValues(room cadump.Room) map[string]interface{} {
+	values := map[string]interface{}{
+		"Hotel name": room.HotelName, "Hotel Code": room.HotelCode, "CI date": room.CIDate,
+		"LOS": int64(room.LOS), "Channel": room.Channel, "Room name": room.RoomName, "Product #": nil,
+		"Rate": room.Rate, "Currency": room.Currency, "Description": room.Description, "Tab name": room.TabName,
+		"Snapshot": room.Snapshot}
+	if room.ProductNum != nil {
+		values["Product #"] = int64(*room.ProductNum)
+	}
+	return values
+}
+
+// ----- Tests -----
+
+func TestNewWriter(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-writer")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	for format, ext := range map[string]string{"": ".csv", "csv": ".csv", "JSONL": ".jsonl",
+		"parquet": ".parquet", "xlsx": ".xlsx"} {
+		writer, err := cadump.NewWriter(format, filepath.Join(tmpFolder, "rooms"), "")
+		ok(t, err)
+		equals(t, filepath.Join(tmpFolder, "rooms"+ext), writer.FileName())
+		ok(t, writer.Close())
+	}
+
+	_, err = cadump.NewWriter("avro", filepath.Join(tmpFolder, "rooms"), "")
+	equals(t, "unknown output format 'avro'", err.Error())
+}
+
+func TestJSONLWriter(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-writer")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	writer, err := cadump.NewJSONLWriter(filepath.Join(tmpFolder, "rooms.jsonl"), "")
+	ok(t, err)
+	ok(t, writer.Write(testRooms()))
+	ok(t, writer.Close())
+
+	data, err := ioutil.ReadFile(writer.FileName())
+	ok(t, err)
+	equals(t, `{"Hotel name":"Beverly Hills","Hotel Code":"BH-19210","CI date":"31/12/2018","LOS":2,`+
+		`"Channel":"Booking","Room name":"","Product #":7,"Rate":"120.50","Currency":"","Description":"",`+
+		`"Tab name":"","Snapshot":""}`+"\n"+
+		`{"Hotel name":"Hotel California","Hotel Code":"HC1980","CI date":"10/11/2018","LOS":1,`+
+		`"Channel":"Marriott","Room name":"","Product #":null,"Rate":"99","Currency":"","Description":"",`+
+		`"Tab name":"","Snapshot":""}`+"\n", string(data))
+}
+
+func TestJSONLWriter_Table(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-writer")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	agg := cadump.NewAggregator("Marriott")
+	agg.AddRooms([]cadump.Room{Room1("Booking"), Room1("Marriott")})
+
+	writer, err := cadump.NewJSONLWriter(filepath.Join(tmpFolder, "counts.jsonl"), "")
+	ok(t, err)
+	ok(t, writer.Write(agg.HotelsCountsTable()))
+	ok(t, writer.Close())
+
+	data, err := ioutil.ReadFile(writer.FileName())
+	ok(t, err)
+	equals(t, `{"Hotel name":"Beverly Hills","Hotel Code":"BH-19210","CI date":"31/12/2018",`+
+		`"Marriott":1,"Other":1}`+"\n", string(data))
+}
+
+func TestParquetWriter(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-writer")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	writer, err := cadump.NewParquetWriter(filepath.Join(tmpFolder, "rooms.parquet"))
+	ok(t, err)
+	ok(t, writer.Write(testRooms()))
+	ok(t, writer.Write(testRooms()[:1]))
+	ok(t, writer.Close())
+
+	file, err := local.NewLocalFileReader(writer.FileName())
+	ok(t, err)
+	defer file.Close()
+
+	pr, err := reader.NewParquetReader(file, nil, 1)
+	ok(t, err)
+	defer pr.ReadStop()
+
+	equals(t, int64(3), pr.GetNumRows())
+
+	var names []string
+	for i := 1; i < len(pr.SchemaHandler.Infos); i++ {
+		names = append(names, pr.SchemaHandler.GetExName(i))
+	}
+	equals(t, []string{"Hotel name", "Hotel Code", "CI date", "LOS", "Channel", "Room name", "Product #",
+		"Rate", "Currency", "Description", "Tab name", "Snapshot"}, names)
+
+	rows, err := pr.ReadByNumber(int(pr.GetNumRows()))
+	ok(t, err)
+	var values []map[string]interface{}
+	for _, row := range rows {
+		values = append(values, parquetValues(pr, row))
+	}
+
+	// the second room has no product number
+	rooms := append(testRooms(), testRooms()[:1]...)
+	equals(t, []map[string]interface{}{roomValues(rooms[0]), roomValues(rooms[1]), roomValues(rooms[2])}, values)
+	equals(t, nil, values[1]["Product #"])
+}
+
+func TestXLSXWriter_ChannelSheets(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-writer")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	writer, err := cadump.NewXLSXWriter(filepath.Join(tmpFolder, "rooms.xlsx"), "Channel")
+	ok(t, err)
+	ok(t, writer.Write(testRooms()))
+	ok(t, writer.Write(testRooms()[:1]))
+	ok(t, writer.Close())
+
+	book, err := excelize.OpenFile(writer.FileName())
+	ok(t, err)
+	defer book.Close()
+
+	equals(t, []string{"Booking", "Marriott"}, book.GetSheetList())
+
+	rows, err := book.GetRows("Booking")
+	ok(t, err)
+	equals(t, 3, len(rows))
+	equals(t, "Hotel name", rows[0][0])
+	equals(t, []string{"Beverly Hills", "BH-19210", "31/12/2018", "2", "Booking", "", "7", "120.50"}, rows[1][:8])
+
+	rows, err = book.GetRows("Marriott")
+	ok(t, err)
+	equals(t, 2, len(rows))
+}
+
+func TestXLSXWriter_RowsLimit(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-writer")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+	defer cadump.SetXLSXMaxRows(3)()
+
+	// header and 2 rooms fit into the sheet
+	longChannel := strings.Repeat("Channel", 5)
+	writer, err := cadump.NewXLSXWriter(filepath.Join(tmpFolder, "rooms.xlsx"), "Channel")
+	ok(t, err)
+	for i := 0; i < 3; i++ {
+		ok(t, writer.Write(append(testRooms(), Room1(longChannel))))
+	}
+	ok(t, writer.Close())
+
+	book, err := excelize.OpenFile(writer.FileName())
+	ok(t, err)
+	defer book.Close()
+
+	longSheet := longChannel[:31]
+	equals(t, []string{"Booking", "Marriott", longSheet, "Booking (2)", "Marriott (2)", longChannel[:27] + " (2)"},
+		book.GetSheetList())
+	for sheet, rooms := range map[string]int{"Booking": 2, "Booking (2)": 1, longSheet: 2, longChannel[:27] + " (2)": 1} {
+		rows, err := book.GetRows(sheet)
+		ok(t, err)
+		equals(t, rooms+1, len(rows))
+		equals(t, "Hotel name", rows[0][0])
+	}
+}
+
+func TestXLSXWriter_Table(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "cadump-writer")
+	ok(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	agg := cadump.NewAggregator("Marriott")
+	agg.AddRooms([]cadump.Room{Room1("Booking"), Room2("Marriott")})
+
+	writer, err := cadump.NewXLSXWriter(filepath.Join(tmpFolder, "counts.xlsx"), "Channel")
+	ok(t, err)
+	ok(t, writer.Write(agg.HotelsCountsTable()))
+	ok(t, writer.Close())
+
+	book, err := excelize.OpenFile(writer.FileName())
+	ok(t, err)
+	defer book.Close()
+
+	equals(t, []string{"Sheet1"}, book.GetSheetList())
+	rows, err := book.GetRows("Sheet1")
+	ok(t, err)
+	equals(t, [][]string{
+		{"Hotel name", "Hotel Code", "CI date", "Marriott", "Other"},
+		{"Beverly Hills", "BH-19210", "31/12/2018", "0", "1"},
+		{"Hotel California", "HC1980", "10/11/2018", "1", "0"}}, rows)
+}
+
+func TestOutputFileName(t *testing.T) {
+	for _, test := range []struct {
+		format, compression, fileName string
+	}{
+		{"", "", "rooms.csv"},
+		{"csv", cadump.CompressionZstd, "rooms.csv.zst"},
+		{"jsonl", cadump.CompressionGzip, "rooms.jsonl.gz"},
+		{"parquet", cadump.CompressionZip, "rooms.parquet"},
+		{"xlsx", cadump.CompressionNone, "rooms.xlsx"},
+	} {
+		fileName, err := cadump.OutputFileName(test.format, "rooms", test.compression)
+		ok(t, err)
+		equals(t, test.fileName, fileName)
+	}
+
+	_, err := cadump.OutputFileName("avro", "rooms", "")
+	equals(t, "unknown output format 'avro'", err.Error())
+}
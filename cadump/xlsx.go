@@ -0,0 +1,193 @@
+package cadump
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	xlsxDefaultSheet  = "Sheet1"
+	xlsxSheetNameSize = 31
+)
+
+// xlsxMaxRows is Excel limit of the sheet rows including the header
+var xlsxMaxRows = 1048576
+
+// ----- XLSX -----
+
+// XLSXWriter save rows into Excel workbook. Rows are split into sheets by the value of the sheet column
+// (e.g. one sheet per channel), rows without the column are saved on the default sheet.
+// Sheets are written in stream mode, so the rows are not kept in memory.
+// Every sheet is limited by Excel to 1048576 rows, the next rows are continued on the "<name> (2)",
+// "<name> (3)" etc. sheets.
+type XLSXWriter struct {
+	fileName    string
+	sheetColumn string
+
+	file   *excelize.File
+	sheets map[string]*xlsxSheet // current sheet by the name of the first one
+	all    []*xlsxSheet          // all sheets in the creation order
+}
+
+// xlsxSheet is stream writer of the sheet and the number of written rows, part is the sheet number
+// of the sheet column value
+type xlsxSheet struct {
+	stream *excelize.StreamWriter
+	rows   int
+	part   int
+}
+
+// NewXLSXWriter is XLSXWriter constructor, empty sheet column save all rows on the single sheet
+func NewXLSXWriter(filePath string, sheetColumn string) (*XLSXWriter, error) {
+	return &XLSXWriter{
+		fileName:    filePath,
+		sheetColumn: sheetColumn,
+		file:        excelize.NewFile(),
+		sheets:      make(map[string]*xlsxSheet)}, nil
+}
+
+// FileName return name of the file the rows are saved to
+func (writer *XLSXWriter) FileName() string {
+	return writer.fileName
+}
+
+// Write append rows to the sheets, header is saved as the first row of every sheet
+func (writer *XLSXWriter) Write(rows interface{}) error {
+	columns, records, err := rowsRecords(rows)
+	if err != nil {
+		return fmt.Errorf("serilize rows into XLSX file '%s' error: %s", writer.fileName, err)
+	}
+
+	sheetIdx := -1
+	for i, col := range columns {
+		if writer.sheetColumn != "" && col.name == writer.sheetColumn {
+			sheetIdx = i
+		}
+	}
+
+	for _, record := range records {
+		sheetName := xlsxDefaultSheet
+		if sheetIdx >= 0 && sheetIdx < len(record) && record[sheetIdx] != nil {
+			sheetName = xlsxSheetName(fmt.Sprint(record[sheetIdx]))
+		}
+
+		sheet, err := writer.sheet(sheetName, columns)
+		if err != nil {
+			return fmt.Errorf("create sheet '%s' in XLSX file '%s' error: %s", sheetName, writer.fileName, err)
+		}
+
+		if sheet.rows >= xlsxMaxRows {
+			if sheet, err = writer.nextSheet(sheetName, sheet, columns); err != nil {
+				return fmt.Errorf("create next sheet of '%s' in XLSX file '%s' error: %s", sheetName, writer.fileName, err)
+			}
+		}
+
+		sheet.rows++
+		cell, _ := excelize.CoordinatesToCellName(1, sheet.rows)
+		if err = sheet.stream.SetRow(cell, record); err != nil {
+			return fmt.Errorf("write XLSX file '%s' error: %s", writer.fileName, err)
+		}
+	}
+	return nil
+}
+
+// Close flush all sheets and save the workbook
+func (writer *XLSXWriter) Close() error {
+	var err error
+	for _, sheet := range writer.all {
+		if ferr := sheet.stream.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+
+	if _, used := writer.sheets[xlsxDefaultSheet]; !used && len(writer.sheets) > 0 {
+		if derr := writer.file.DeleteSheet(xlsxDefaultSheet); derr != nil && err == nil {
+			err = derr
+		}
+	}
+
+	if err == nil {
+		err = writer.file.SaveAs(writer.fileName)
+	}
+	if cerr := writer.file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("close XLSX file '%s' error: %s", writer.fileName, err)
+	}
+	return nil
+}
+
+// sheet return stream writer of the sheet, new sheet is created with the header row
+func (writer *XLSXWriter) sheet(name string, columns []column) (*xlsxSheet, error) {
+	if sheet, exists := writer.sheets[name]; exists {
+		return sheet, nil
+	}
+
+	sheet, err := writer.newSheet(name, columns)
+	if err != nil {
+		return nil, err
+	}
+	sheet.part = 1
+	writer.sheets[name] = sheet
+	return sheet, nil
+}
+
+// nextSheet create the next sheet of the full one, the name is cut to fit the part number
+func (writer *XLSXWriter) nextSheet(name string, full *xlsxSheet, columns []column) (*xlsxSheet, error) {
+	partName := name
+	suffix := fmt.Sprintf(" (%d)", full.part+1)
+	if runes := []rune(partName); len(runes)+len(suffix) > xlsxSheetNameSize {
+		partName = string(runes[:xlsxSheetNameSize-len(suffix)])
+	}
+
+	sheet, err := writer.newSheet(partName+suffix, columns)
+	if err != nil {
+		return nil, err
+	}
+	sheet.part = full.part + 1
+	writer.sheets[name] = sheet
+	return sheet, nil
+}
+
+// newSheet add the sheet to the workbook and write the header row
+func (writer *XLSXWriter) newSheet(name string, columns []column) (*xlsxSheet, error) {
+	if name != xlsxDefaultSheet {
+		if _, err := writer.file.NewSheet(name); err != nil {
+			return nil, err
+		}
+	}
+
+	stream, err := writer.file.NewStreamWriter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]interface{}, len(columns))
+	for i, col := range columns {
+		header[i] = col.name
+	}
+	if err = stream.SetRow("A1", header); err != nil {
+		return nil, err
+	}
+	sheet := &xlsxSheet{stream: stream, rows: 1}
+	writer.all = append(writer.all, sheet)
+	return sheet, nil
+}
+
+// xlsxSheetName replace characters not allowed in the sheet name and cut it to the Excel limit
+func xlsxSheetName(name string) string {
+	name = strings.NewReplacer(":", "_", "\\", "_", "/", "_", "?", "_", "*", "_", "[", "_", "]", "_").
+		Replace(strings.TrimSpace(name))
+	if name == "" {
+		return xlsxDefaultSheet
+	}
+
+	if runes := []rune(name); len(runes) > xlsxSheetNameSize {
+		name = string(runes[:xlsxSheetNameSize])
+	}
+	return name
+}
@@ -1,14 +1,464 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/integrii/flaggy"
+
 	"cadump/cadump"
 )
 
+const description = `is Cassandra scan results processing script.
+It extracts the results of the scan from Cassandra 'scan_data' table with specified scan_id.
+Script splits those results by rooms and also counts the number of rooms for each hotel and provider.
+All results saved in temp files and uploaded on FTP.
+`
+
+// exitCodes map the failed stage to the process exit code
+var exitCodes = map[cadump.Stage]int{
+	cadump.StageConfig:  2,
+	cadump.StageConnect: 3,
+	cadump.StageQuery:   4,
+	cadump.StageParse:   5,
+	cadump.StageWrite:   6,
+	cadump.StageUpload:  7,
+
+	// 128 + SIGINT as shells do for the interrupted process
+	cadump.StageCanceled: 130,
+}
+
 func main() {
 	start := time.Now()
-	cadump.ProcessScan()
+
+	if err := run(); err != nil {
+		stage, _ := cadump.ErrorStage(err)
+		cadump.LogWith(cadump.Fields{"stage": stage}).Errorf("Failed in %s: %s", time.Since(start), err)
+		os.Exit(exitCode(err))
+	}
+
 	fmt.Printf("Done in %s\n", time.Since(start))
 }
+
+const (
+	configHelp  = "Project YAML configuration file"
+	sidHelp     = "Scan ID to process (can to set multiple values)"
+	workersHelp = "Number of scans processed in parallel (overrides WORKERS config)"
+	dryRunHelp  = "Read and process scans, print summary without writing files and uploading"
+	lenientHelp = "Skip rows which can't be parsed and save them into rejects file (overrides LENIENT config)"
+	resumeHelp  = "Continue failed export of the same scan IDs from the checkpoint (requires CHECKPOINT_ROWS config)"
+
+	logLevelHelp  = "Log level: DEBUG, INFO, WARNING or ERROR (overrides LOG.level config)"
+	logFormatHelp = "Log format: text or json (overrides LOG.format config)"
+	logFileHelp   = "Log file, stderr by default (overrides LOG.file config)"
+
+	hotelCodeHelp = "Export only rooms of the hotel code (can to set multiple values, overrides FILTER config)"
+	channelHelp   = "Export only rooms of the channel (can to set multiple values, overrides FILTER config)"
+	ciFromHelp    = "Export only check-ins from the date: YYYY-MM-DD, today, +N or -N days (overrides FILTER config)"
+	ciToHelp      = "Export only check-ins up to the date: YYYY-MM-DD, today, +N or -N days (overrides FILTER config)"
+	losHelp       = "Export only rooms with the length of stay (can to set multiple values, overrides FILTER config)"
+
+	inspectLimit = 5
+)
+
+// args is parsed command line arguments
+type args struct {
+	command string // empty for export with upload
+
+	configFile string
+	log        cadump.LogConfig
+	scanIDs    []uint
+	workers    int
+	dryRun     bool
+	lenient    bool
+	resume     bool
+
+	// rooms filter
+	hotelCodes []string
+	channels   []string
+	ciFrom     string
+	ciTo       string
+	los        []uint
+
+	// inspect
+	limit int
+
+	// upload
+	files []string
+
+	// watch
+	interval  time.Duration
+	stateFile string
+}
+
+// command is CLI subcommand
+type command struct {
+	name        string
+	description string
+	scans       bool // scan IDs required
+	flags       func(sc *flaggy.Subcommand, cmdArgs *args)
+	run         func(ctx context.Context, config cadump.Config, cmdArgs args) error
+}
+
+var commands = []command{
+	{
+		name:        "export",
+		description: "Save rooms files of the scans into TMP_FOLDER without upload",
+		scans:       true,
+		flags:       scansFlags,
+		run: func(ctx context.Context, config cadump.Config, cmdArgs args) error {
+			return exportFiles(ctx, config, cmdArgs, cadump.OutputRooms)
+		},
+	},
+	{
+		name:        "counts",
+		description: "Save hotels counts file of the scans into TMP_FOLDER without upload",
+		scans:       true,
+		flags:       scansFlags,
+		run: func(ctx context.Context, config cadump.Config, cmdArgs args) error {
+			return exportFiles(ctx, config, cmdArgs, cadump.OutputHotelsCounts)
+		},
+	},
+	{
+		name:        "inspect",
+		description: "Print first rows of the scan decoded from 'scan_data' table as JSON",
+		scans:       true,
+		flags: func(sc *flaggy.Subcommand, cmdArgs *args) {
+			sc.UIntSlice(&cmdArgs.scanIDs, "s", "sid", "Scan ID to inspect")
+			sc.Int(&cmdArgs.limit, "n", "limit", fmt.Sprintf("Number of rows to print (default %d)", inspectLimit))
+		},
+		run: inspectScan,
+	},
+	{
+		name:        "upload",
+		description: "Deliver existing files to all configured destinations",
+		flags: func(sc *flaggy.Subcommand, cmdArgs *args) {
+			sc.StringSlice(&cmdArgs.files, "f", "file", "File to upload (can to set multiple values)")
+		},
+		run: uploadFiles,
+	},
+	{
+		name:        "validate-config",
+		description: "Load config and check connection to Cassandra and destinations",
+		flags:       func(sc *flaggy.Subcommand, cmdArgs *args) {},
+		run: func(ctx context.Context, config cadump.Config, cmdArgs args) error {
+			if err := cadump.CheckConnections(ctx, config); err != nil {
+				return err
+			}
+			fmt.Println("Config is valid")
+			return nil
+		},
+	},
+	{
+		name:        "watch",
+		description: "Poll Cassandra for finished scans and export every new one",
+		flags: func(sc *flaggy.Subcommand, cmdArgs *args) {
+			sc.Int(&cmdArgs.workers, "w", "workers", workersHelp)
+			filterFlags(sc, cmdArgs)
+			sc.Duration(&cmdArgs.interval, "i", "interval", "Polling interval (overrides WATCH.interval config)")
+			sc.String(&cmdArgs.stateFile, "", "state", "Exported scans state file (overrides WATCH.state_file config)")
+		},
+		run: func(ctx context.Context, config cadump.Config, cmdArgs args) error {
+			if cmdArgs.interval > 0 {
+				config.Watch.Interval = cmdArgs.interval
+			}
+			if cmdArgs.stateFile != "" {
+				config.Watch.StateFile = cmdArgs.stateFile
+			}
+			return cadump.Watch(ctx, config)
+		},
+	},
+}
+
+// run parse arguments, load config and run the command until SIGINT/SIGTERM
+func run() error {
+	// default stderr log until the config is loaded
+	if _, err := cadump.InitLogger(cadump.LogConfig{}); err != nil {
+		return &cadump.StageError{Stage: cadump.StageConfig, Err: err}
+	}
+
+	cmdArgs, err := parseArgs()
+	if err != nil {
+		return &cadump.StageError{Stage: cadump.StageConfig, Err: fmt.Errorf("arguments parse error: %s", err)}
+	}
+
+	config, err := cadump.LoadConfig(cmdArgs.configFile)
+	if err != nil {
+		return &cadump.StageError{Stage: cadump.StageConfig, Err: fmt.Errorf("load config error: %s", err)}
+	}
+
+	logCloser, err := initLogger(config.Log, cmdArgs.log)
+	if err != nil {
+		return &cadump.StageError{Stage: cadump.StageConfig, Err: fmt.Errorf("log config error: %s", err)}
+	}
+	defer logCloser.Close()
+
+	if cmdArgs.workers > 0 {
+		config.Workers = cmdArgs.workers
+	}
+	if cmdArgs.lenient {
+		config.Lenient = true
+	}
+	setFilter(&config.Filter, cmdArgs)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, cmd := range commands {
+		if cmd.name == cmdArgs.command {
+			return cmd.run(ctx, config, cmdArgs)
+		}
+	}
+
+	if cmdArgs.dryRun {
+		return dryRun(ctx, config, cmdArgs.scanIDs)
+	}
+
+	var options []cadump.Option
+	if cmdArgs.resume {
+		options = append(options, cadump.WithResume())
+	}
+
+	_, err = cadump.Run(ctx, config, cmdArgs.scanIDs, options...)
+	pushMetrics(config)
+	return err
+}
+
+func parseArgs() (cmdArgs args, err error) {
+	flaggy.SetName("cadump")
+	flaggy.SetDescription(description)
+	flaggy.SetVersion(cadump.Version)
+
+	flaggy.String(&cmdArgs.configFile, "c", "config", configHelp)
+	flaggy.String(&cmdArgs.log.Level, "", "log-level", logLevelHelp)
+	flaggy.String(&cmdArgs.log.Format, "", "log-format", logFormatHelp)
+	flaggy.String(&cmdArgs.log.File, "", "log-file", logFileHelp)
+	flaggy.UIntSlice(&cmdArgs.scanIDs, "s", "sid", sidHelp)
+	flaggy.Int(&cmdArgs.workers, "w", "workers", workersHelp)
+	flaggy.Bool(&cmdArgs.dryRun, "", "dry-run", dryRunHelp)
+	flaggy.Bool(&cmdArgs.lenient, "", "lenient", lenientHelp)
+	flaggy.Bool(&cmdArgs.resume, "", "resume", resumeHelp)
+	flaggy.StringSlice(&cmdArgs.hotelCodes, "", "hotel-code", hotelCodeHelp)
+	flaggy.StringSlice(&cmdArgs.channels, "", "channel", channelHelp)
+	flaggy.String(&cmdArgs.ciFrom, "", "ci-from", ciFromHelp)
+	flaggy.String(&cmdArgs.ciTo, "", "ci-to", ciToHelp)
+	flaggy.UIntSlice(&cmdArgs.los, "", "los", losHelp)
+
+	subcommands := make([]*flaggy.Subcommand, len(commands))
+	for i, cmd := range commands {
+		subcommands[i] = flaggy.NewSubcommand(cmd.name)
+		subcommands[i].Description = cmd.description
+		subcommands[i].String(&cmdArgs.configFile, "c", "config", configHelp)
+		subcommands[i].String(&cmdArgs.log.Level, "", "log-level", logLevelHelp)
+		subcommands[i].String(&cmdArgs.log.Format, "", "log-format", logFormatHelp)
+		subcommands[i].String(&cmdArgs.log.File, "", "log-file", logFileHelp)
+		cmd.flags(subcommands[i], &cmdArgs)
+		flaggy.AttachSubcommand(subcommands[i], 1)
+	}
+
+	flaggy.Parse()
+
+	scansRequired := true
+	for i, cmd := range commands {
+		if subcommands[i].Used {
+			cmdArgs.command, scansRequired = cmd.name, cmd.scans
+		}
+	}
+
+	if cmdArgs.configFile == "" {
+		return cmdArgs, fmt.Errorf("configuration YAML file not set")
+	}
+	if len(cmdArgs.scanIDs) == 0 && scansRequired {
+		return cmdArgs, fmt.Errorf("scan id not set")
+	}
+	if cmdArgs.workers < 0 {
+		return cmdArgs, fmt.Errorf("workers number must be positive")
+	}
+	if cmdArgs.command == "upload" && len(cmdArgs.files) == 0 {
+		return cmdArgs, fmt.Errorf("files to upload not set")
+	}
+
+	return cmdArgs, nil
+}
+
+// initLogger set up log of the config, set flags override config values
+func initLogger(config cadump.LogConfig, flags cadump.LogConfig) (io.Closer, error) {
+	if flags.Level != "" {
+		config.Level = flags.Level
+	}
+	if flags.Format != "" {
+		config.Format = flags.Format
+	}
+	if flags.File != "" {
+		config.File = flags.File
+	}
+	return cadump.InitLogger(config)
+}
+
+// scansFlags add scan IDs and workers flags to the subcommand
+func scansFlags(sc *flaggy.Subcommand, cmdArgs *args) {
+	sc.UIntSlice(&cmdArgs.scanIDs, "s", "sid", sidHelp)
+	sc.Int(&cmdArgs.workers, "w", "workers", workersHelp)
+	sc.Bool(&cmdArgs.dryRun, "", "dry-run", dryRunHelp)
+	sc.Bool(&cmdArgs.lenient, "", "lenient", lenientHelp)
+	sc.Bool(&cmdArgs.resume, "", "resume", resumeHelp)
+	filterFlags(sc, cmdArgs)
+}
+
+// filterFlags add rooms filter flags to the subcommand
+func filterFlags(sc *flaggy.Subcommand, cmdArgs *args) {
+	sc.StringSlice(&cmdArgs.hotelCodes, "", "hotel-code", hotelCodeHelp)
+	sc.StringSlice(&cmdArgs.channels, "", "channel", channelHelp)
+	sc.String(&cmdArgs.ciFrom, "", "ci-from", ciFromHelp)
+	sc.String(&cmdArgs.ciTo, "", "ci-to", ciToHelp)
+	sc.UIntSlice(&cmdArgs.los, "", "los", losHelp)
+}
+
+// setFilter override config filters by the set filter flags
+func setFilter(filter *cadump.FilterConfig, cmdArgs args) {
+	if len(cmdArgs.hotelCodes) > 0 {
+		filter.HotelCodes = cmdArgs.hotelCodes
+	}
+	if len(cmdArgs.channels) > 0 {
+		filter.Channels = cmdArgs.channels
+	}
+	if cmdArgs.ciFrom != "" {
+		filter.CIFrom = cmdArgs.ciFrom
+	}
+	if cmdArgs.ciTo != "" {
+		filter.CITo = cmdArgs.ciTo
+	}
+	if len(cmdArgs.los) > 0 {
+		filter.LOS = cmdArgs.los
+	}
+}
+
+// exportFiles save single output of the scans, files are kept in TMP_FOLDER and printed
+func exportFiles(ctx context.Context, config cadump.Config, cmdArgs args, output string) error {
+	config.RemoveTMPFiles = false
+
+	options := []cadump.Option{cadump.WithOutputs(output), cadump.WithUploaders()}
+	if cmdArgs.dryRun {
+		options = append(options, cadump.WithDryRun())
+	}
+	if cmdArgs.resume {
+		options = append(options, cadump.WithResume())
+	}
+
+	report, err := cadump.Run(ctx, config, cmdArgs.scanIDs, options...)
+	pushMetrics(config)
+	if err != nil {
+		return err
+	}
+	if report.DryRun {
+		printSummary(report)
+		return nil
+	}
+
+	for _, scan := range report.Scans {
+		for _, file := range []string{scan.FileName, scan.RejectsFile} {
+			if file != "" {
+				fmt.Println(file)
+			}
+		}
+	}
+	for _, file := range []string{report.HotelsCountsFile, report.BundleFile, report.ManifestFile} {
+		if file != "" {
+			fmt.Println(file)
+		}
+	}
+	return nil
+}
+
+// pushMetrics send metrics of the one-shot export to the Pushgateway if it is set, failed push doesn't fail the export
+func pushMetrics(config cadump.Config) {
+	if config.Metrics.Pushgateway == "" {
+		return
+	}
+	if err := cadump.PushMetrics(config.Metrics); err != nil {
+		cadump.LogWith(cadump.Fields{"stage": cadump.StageUpload}).Warningf("%s", err)
+	}
+}
+
+// dryRun process scans without writing and uploading files and print the summary
+func dryRun(ctx context.Context, config cadump.Config, scanIDs []uint) error {
+	report, err := cadump.Run(ctx, config, scanIDs, cadump.WithDryRun())
+	if err != nil {
+		return err
+	}
+	printSummary(report)
+	return nil
+}
+
+// printSummary print scans summary and files of the dry run
+func printSummary(report cadump.Report) {
+	fmt.Println("Dry run, nothing is written or uploaded")
+	for _, scan := range report.Scans {
+		fmt.Printf("Scan %d: rows %d, rooms %d, rejects %d, hotels %d, channels [%s], check-in dates %s - %s\n",
+			scan.ScanID, scan.Rows, scan.Rooms, scan.Rejects, scan.Hotels, strings.Join(scan.Channels, ", "),
+			scan.CIDateFrom, scan.CIDateTo)
+		if scan.FileName != "" {
+			fmt.Printf("  rooms file: %s\n", scan.FileName)
+		}
+		if scan.RejectsFile != "" {
+			fmt.Printf("  rejects file: %s\n", scan.RejectsFile)
+		}
+	}
+
+	if report.HotelsCountsFile != "" {
+		fmt.Printf("Hotels counts file: %s (%d rows)\n", report.HotelsCountsFile, report.HotelsCountsRows)
+	}
+	if report.BundleFile != "" {
+		fmt.Printf("Bundle file: %s\n", report.BundleFile)
+	}
+	fmt.Printf("Manifest file: %s\n", report.ManifestFile)
+}
+
+// inspectScan print first rows of the first scan
+func inspectScan(ctx context.Context, config cadump.Config, cmdArgs args) error {
+	limit := cmdArgs.limit
+	if limit <= 0 {
+		limit = inspectLimit
+	}
+
+	db := cadump.NewCassandraReader(config.Cassandra)
+	defer db.Close()
+
+	return cadump.InspectScan(ctx, db, cmdArgs.scanIDs[0], limit, os.Stdout)
+}
+
+// uploadFiles deliver existing files to the configured destinations
+func uploadFiles(ctx context.Context, config cadump.Config, cmdArgs args) error {
+	for _, file := range cmdArgs.files {
+		if _, err := os.Stat(file); err != nil {
+			return &cadump.StageError{Stage: cadump.StageConfig, Err: fmt.Errorf("upload file error: %s", err)}
+		}
+	}
+
+	uploaders, err := cadump.NewUploaders(config)
+	if err != nil {
+		return &cadump.StageError{Stage: cadump.StageConfig, Err: err}
+	}
+	defer cadump.CloseUploaders(uploaders)
+
+	if err = cadump.UploadFiles(ctx, cmdArgs.files, uploaders); err != nil {
+		return &cadump.StageError{Stage: cadump.StageUpload, Err: err}
+	}
+	return nil
+}
+
+// exitCode return exit code of the error stage (1 for unknown errors)
+func exitCode(err error) int {
+	if stage, ok := cadump.ErrorStage(err); ok {
+		if code, ok := exitCodes[stage]; ok {
+			return code
+		}
+	}
+	return 1
+}
@@ -1,18 +1,28 @@
 module cadump
 
+go 1.20
+
 require (
 	github.com/bitly/go-hostpool v0.0.0-20171023180738-a3a6125de932 // indirect
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/gocarina/gocsv/v2 v2.0.0-20181026075406-cde31a6ec2a8
-	github.com/gocql/gocql v0.0.0-20181109100135-9de8c0414fd7
+	github.com/gocql/gocql v0.0.0-20200526081602-cd04bd7f22a7
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
 	github.com/integrii/flaggy v0.0.0-20181007032133-1056ce330646
-	github.com/jlaffaye/ftp v0.0.0-20181101112434-47f21d10f0ee
+	github.com/jlaffaye/ftp v0.1.0
+	github.com/klauspost/compress v1.13.1
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	github.com/pkg/sftp v1.13.9
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_golang v1.14.0
 	github.com/scylladb/gocqlx v0.0.0-20181123161704-8ea6a9d5f506
 	github.com/stretchr/testify v1.2.2 // indirect
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	github.com/xuri/excelize/v2 v2.8.1
+	golang.org/x/crypto v0.31.0
+	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
 	gopkg.in/yaml.v2 v2.2.1
 )